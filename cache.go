@@ -0,0 +1,314 @@
+package main
+
+import (
+	"container/list"
+	"io"
+	"sync"
+	"time"
+)
+
+// CachedStore caches object metadata (Head) and listings (List) from another ObjectStore for a TTL, so the bursts of
+// CWD, LIST, SIZE and MDTM commands FTP clients send don't all go to S3.  Writes made through the CachedStore (uploads,
+// deletes, renames and mkdir) invalidate the cached metadata for their keys and the listings that could include them.
+// Changes made by anything else (another server or the S3 console) are seen once the cached entries expire.
+type CachedStore struct {
+	ObjectStore
+
+	ttl  time.Duration
+	size int // the maximum number of cached heads and listings
+	now  func() time.Time
+
+	mu    sync.Mutex
+	heads map[string]cacheEntry
+	lists map[string]map[listKey]cacheEntry // by prefix, to find the listings a key could be in
+	// the keys of the cached heads and listings in the order they expire, which is the order they were cached in
+	order  *list.List
+	hits   uint64
+	misses uint64
+	// bumped by every invalidation, so a value fetched while one happened isn't cached (it could be from before it)
+	gen uint64
+}
+
+type cacheEntry struct {
+	value interface{}   // *ObjectInfo or *ObjectList
+	elem  *list.Element // the entry's cacheItem in CachedStore.order
+}
+
+// cacheItem is an entry in CachedStore.order.  The key is a string for a head or a listKey for a listing.
+type cacheItem struct {
+	key     interface{}
+	expires time.Time
+}
+
+type listKey struct {
+	prefix, delimiter, continuationToken string
+}
+
+// Cache is a CachedStore from NewCachedStore
+type Cache interface {
+	ObjectStore
+	Stats() (hits, misses uint64, entries int)
+}
+
+// NewCachedStore returns a CachedStore for store.  It's also a MultipartStore and a MetadataStore if store is, so it
+// can be used in place of store.
+func NewCachedStore(store ObjectStore, ttl time.Duration, size int) Cache {
+	c := newCachedStore(store, ttl, size)
+
+	uploads, isMultipart := store.(MultipartStore)
+	metadata, isMetadata := store.(MetadataStore)
+
+	switch {
+	case isMultipart && isMetadata:
+		return cachedMultipartMetadataStore{c, cachedMultipartStore{c, uploads}, cachedMetadataStore{c, metadata}}
+	case isMultipart:
+		return cachedMultipartStore{c, uploads}
+	case isMetadata:
+		return cachedMetadataStore{c, metadata}
+	}
+
+	return c
+}
+
+func newCachedStore(store ObjectStore, ttl time.Duration, size int) *CachedStore {
+	return &CachedStore{
+		ObjectStore: store,
+		ttl:         ttl,
+		size:        size,
+		now:         time.Now,
+		heads:       make(map[string]cacheEntry),
+		lists:       make(map[string]map[listKey]cacheEntry),
+		order:       list.New(),
+	}
+}
+
+func (c *CachedStore) List(prefix, delimiter, continuationToken string) (*ObjectList, error) {
+	k := listKey{prefix, delimiter, continuationToken}
+
+	c.mu.Lock()
+	e, ok := c.lookup(c.lists[prefix][k])
+	gen := c.gen
+	c.mu.Unlock()
+
+	if ok {
+		return e.(*ObjectList), nil
+	}
+
+	objects, err := c.ObjectStore.List(prefix, delimiter, continuationToken)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	if c.gen == gen {
+		c.add(k, objects)
+	}
+	c.mu.Unlock()
+
+	return objects, nil
+}
+
+func (c *CachedStore) Head(key string) (*ObjectInfo, error) {
+	c.mu.Lock()
+	e, ok := c.lookup(c.heads[key])
+	gen := c.gen
+	c.mu.Unlock()
+
+	if ok {
+		info := *e.(*ObjectInfo)
+		return &info, nil
+	}
+
+	info, err := c.ObjectStore.Head(key)
+	if err != nil {
+		return nil, err
+	}
+
+	cached := *info
+
+	c.mu.Lock()
+	if c.gen == gen {
+		c.add(key, &cached)
+	}
+	c.mu.Unlock()
+
+	return info, nil
+}
+
+func (c *CachedStore) Put(key string, body io.Reader) error {
+	// invalidate before and after, the object changes when the upload completes but a failed upload can still have
+	// replaced it
+	c.invalidate(key)
+	defer c.invalidate(key)
+
+	return c.ObjectStore.Put(key, body)
+}
+
+func (c *CachedStore) Copy(srcKey, dstKey string, size int64) error {
+	defer c.invalidate(dstKey)
+
+	return c.ObjectStore.Copy(srcKey, dstKey, size)
+}
+
+func (c *CachedStore) Delete(keys []string) error {
+	defer c.invalidate(keys...)
+
+	return c.ObjectStore.Delete(keys)
+}
+
+// cachedMultipartStore is a CachedStore for a MultipartStore.  The multipart upload methods are passed through to the
+// underlying store, and completing an upload invalidates the object like Put.
+type cachedMultipartStore struct {
+	*CachedStore
+	uploads MultipartStore
+}
+
+func (c cachedMultipartStore) Uploads(prefix string) ([]Upload, error) {
+	return c.uploads.Uploads(prefix)
+}
+
+func (c cachedMultipartStore) CreateUpload(key string) (string, error) {
+	return c.uploads.CreateUpload(key)
+}
+
+func (c cachedMultipartStore) UploadPart(key, uploadID string, partNumber int, body io.ReadSeeker) (string, error) {
+	return c.uploads.UploadPart(key, uploadID, partNumber, body)
+}
+
+func (c cachedMultipartStore) CopyPart(key, uploadID string, partNumber int, srcKey string, offset,
+	size int64) (string, error) {
+	return c.uploads.CopyPart(key, uploadID, partNumber, srcKey, offset, size)
+}
+
+func (c cachedMultipartStore) Parts(key, uploadID string) ([]Part, error) {
+	return c.uploads.Parts(key, uploadID)
+}
+
+func (c cachedMultipartStore) CompleteUpload(key, uploadID string, parts []Part) (string, error) {
+	c.invalidate(key)
+	defer c.invalidate(key)
+
+	return c.uploads.CompleteUpload(key, uploadID, parts)
+}
+
+func (c cachedMultipartStore) AbortUpload(key, uploadID string) error {
+	return c.uploads.AbortUpload(key, uploadID)
+}
+
+// cachedMetadataStore is a CachedStore for a MetadataStore
+type cachedMetadataStore struct {
+	*CachedStore
+	metadata MetadataStore
+}
+
+// PutWithMetadata is passed through to the underlying store and invalidates the object like Put
+func (c cachedMetadataStore) PutWithMetadata(key string, body io.Reader, metadata map[string]string) error {
+	c.invalidate(key)
+	defer c.invalidate(key)
+
+	return c.metadata.PutWithMetadata(key, body, metadata)
+}
+
+// cachedMultipartMetadataStore is a CachedStore for a store that is both a MultipartStore and a MetadataStore.  The
+// ObjectStore methods come from the CachedStore, which is shallower than the ones in the other two.
+type cachedMultipartMetadataStore struct {
+	*CachedStore
+	cachedMultipartStore
+	cachedMetadataStore
+}
+
+// Stats returns the number of cache hits, misses and the current number of cached entries
+func (c *CachedStore) Stats() (hits, misses uint64, entries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.hits, c.misses, c.order.Len()
+}
+
+// lookup returns the cached value if the entry hasn't expired and counts the hit or miss.  c.mu must be held.
+func (c *CachedStore) lookup(e cacheEntry) (interface{}, bool) {
+	if e.value == nil || !c.now().Before(e.elem.Value.(cacheItem).expires) {
+		c.misses++
+		return nil, false
+	}
+
+	c.hits++
+	return e.value, true
+}
+
+// add caches the value of a head (a string key) or listing (a listKey), making room for it.  c.mu must be held.
+func (c *CachedStore) add(key, value interface{}) {
+	c.remove(key)
+	c.makeRoom()
+
+	e := cacheEntry{value: value, elem: c.order.PushBack(cacheItem{key, c.now().Add(c.ttl)})}
+
+	switch k := key.(type) {
+	case string:
+		c.heads[k] = e
+	case listKey:
+		if c.lists[k.prefix] == nil {
+			c.lists[k.prefix] = make(map[listKey]cacheEntry)
+		}
+		c.lists[k.prefix][k] = e
+	}
+}
+
+// remove removes a head (a string key) or listing (a listKey) from the cache if it's there.  c.mu must be held.
+func (c *CachedStore) remove(key interface{}) {
+	switch k := key.(type) {
+	case string:
+		if e, ok := c.heads[k]; ok {
+			c.order.Remove(e.elem)
+			delete(c.heads, k)
+		}
+	case listKey:
+		if e, ok := c.lists[k.prefix][k]; ok {
+			c.order.Remove(e.elem)
+			delete(c.lists[k.prefix], k)
+			if len(c.lists[k.prefix]) == 0 {
+				delete(c.lists, k.prefix)
+			}
+		}
+	}
+}
+
+// invalidate removes the cached metadata for the keys and any listings that could include them, which are those with
+// a prefix that is the start of a key
+func (c *CachedStore) invalidate(keys ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+
+	for _, key := range keys {
+		c.remove(key)
+
+		for i := 0; i <= len(key) && len(c.lists) > 0; i++ {
+			for k := range c.lists[key[:i]] {
+				c.remove(k)
+			}
+		}
+	}
+}
+
+// makeRoom removes expired entries, and then the entries closest to expiring until there's room for another one.
+// c.mu must be held.
+func (c *CachedStore) makeRoom() {
+	now := c.now()
+
+	for e := c.order.Front(); e != nil; e = c.order.Front() {
+		item := e.Value.(cacheItem)
+		if c.order.Len() < c.size && now.Before(item.expires) {
+			return
+		}
+
+		c.remove(item.key)
+	}
+}
+
+var _ Cache = &CachedStore{}
+var _ MultipartStore = cachedMultipartStore{}
+var _ MetadataStore = cachedMetadataStore{}
+var _ MultipartStore = cachedMultipartMetadataStore{}
+var _ MetadataStore = cachedMultipartMetadataStore{}
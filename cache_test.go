@@ -0,0 +1,291 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCachedStore(t *testing.T) {
+	mem := NewMemStore()
+	mem.pageSize = 1000
+
+	store := &countingStore{ObjectStore: mem}
+	c := newCachedStore(store, time.Minute, 100)
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	if err := c.Put("dir/", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Put("dir/a.txt", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	// repeated lookups are cached
+	for i := 0; i < 3; i++ {
+		if _, err := c.Head("dir/a.txt"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := c.List("dir/", "/", ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if store.heads != 1 || store.lists != 1 {
+		t.Errorf("expected 1 head and 1 list, got %d and %d", store.heads, store.lists)
+	}
+
+	if hits, misses, _ := c.Stats(); hits != 4 || misses != 2 {
+		t.Errorf("expected 4 hits and 2 misses, got %d and %d", hits, misses)
+	}
+
+	// writes invalidate the object and the listings it's in, including the root listing
+	if _, err := c.List("", "/", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Put("dir/a.txt", strings.NewReader("changed")); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := c.Head("dir/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Size != int64(len("changed")) {
+		t.Errorf("expected the new size after a write, got %d", info.Size)
+	}
+
+	if _, err = c.List("", "/", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.heads != 2 || store.lists != 3 {
+		t.Errorf("expected 2 heads and 3 lists after a write, got %d and %d", store.heads, store.lists)
+	}
+
+	// listings of other directories aren't affected
+	if _, err = c.List("other/", "/", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = c.Copy("dir/a.txt", "dir/b.txt", 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.List("other/", "/", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if store.lists != 4 {
+		t.Errorf("expected a cached listing of other/, got %d lists", store.lists)
+	}
+
+	list, err := c.List("dir/", "/", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(list.Objects) != 3 {
+		t.Errorf("expected the copy in the listing, got %d objects", len(list.Objects))
+	}
+
+	if err = c.Delete([]string{"dir/a.txt", "dir/b.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = c.Head("dir/a.txt"); err == nil {
+		t.Error("expected a deleted object to be removed from the cache")
+	}
+
+	// entries expire
+	heads := store.heads
+	c.Head("dir/")
+	c.Head("dir/")
+	now = now.Add(2 * time.Minute)
+	c.Head("dir/")
+
+	if store.heads != heads+2 {
+		t.Errorf("expected an expired entry to be looked up again, got %d heads", store.heads-heads)
+	}
+}
+
+// interleaveStore calls during after fetching from the store, as if it happened while the request was in flight
+type interleaveStore struct {
+	ObjectStore
+	during func()
+}
+
+func (s *interleaveStore) Head(key string) (*ObjectInfo, error) {
+	info, err := s.ObjectStore.Head(key)
+	if s.during != nil {
+		s.during()
+	}
+
+	return info, err
+}
+
+func (s *interleaveStore) List(prefix, delimiter, continuationToken string) (*ObjectList, error) {
+	list, err := s.ObjectStore.List(prefix, delimiter, continuationToken)
+	if s.during != nil {
+		s.during()
+	}
+
+	return list, err
+}
+
+// a value fetched while a write invalidates the cache isn't cached, it could be from before the write
+func TestCachedStoreWriteDuringFetch(t *testing.T) {
+	mem := NewMemStore()
+	store := &interleaveStore{ObjectStore: mem}
+	c := newCachedStore(store, time.Minute, 100)
+
+	if err := c.Put("a.txt", strings.NewReader("a")); err != nil {
+		t.Fatal(err)
+	}
+
+	store.during = func() {
+		store.during = nil
+		if err := c.Put("a.txt", strings.NewReader("changed")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.Head("a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := c.Head("a.txt"); err != nil || info.Size != int64(len("changed")) {
+		t.Errorf("expected the size after the write: %v %v", info, err)
+	}
+
+	store.during = func() {
+		store.during = nil
+		if err := c.Put("b.txt", strings.NewReader("b")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := c.List("", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if list, err := c.List("", "", ""); err != nil || len(list.Objects) != 2 {
+		t.Errorf("expected the listing after the write: %v %v", list, err)
+	}
+}
+
+func TestCachedStoreSize(t *testing.T) {
+	mem := NewMemStore()
+	c := newCachedStore(mem, time.Minute, 10)
+
+	now := time.Now()
+	c.now = func() time.Time { return now }
+
+	for i := 0; i < 20; i++ {
+		key := strings.Repeat("a", i+1)
+		if err := mem.Put(key, strings.NewReader("")); err != nil {
+			t.Fatal(err)
+		}
+
+		now = now.Add(time.Second)
+		if _, err := c.Head(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, entries := c.Stats(); entries != 10 {
+		t.Errorf("expected the cache to be limited to 10 entries, got %d", entries)
+	}
+
+	// the most recent entries are kept
+	if _, ok := c.heads[strings.Repeat("a", 20)]; !ok {
+		t.Error("expected the newest entry to be cached")
+	}
+
+	if _, ok := c.heads["a"]; ok {
+		t.Error("expected the oldest entry to be evicted")
+	}
+
+	// expired entries are dropped when another is added
+	now = now.Add(2 * time.Minute)
+	if _, err := c.List("a", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, entries := c.Stats(); entries != 1 {
+		t.Errorf("expected the expired entries to be dropped, got %d", entries)
+	}
+
+	// a listing with a prefix that isn't a directory is invalidated by the keys starting with it
+	if err := c.Put("ab", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, entries := c.Stats(); entries != 0 {
+		t.Errorf("expected the listing to be invalidated, got %d entries", entries)
+	}
+}
+
+// the cache only has the multipart upload and metadata methods of the store it caches
+func TestCachedStoreCapabilities(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucketftp-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFSStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewCachedStore(fs, time.Minute, 100)
+	if _, ok := c.(MultipartStore); ok {
+		t.Error("expected a cached fs store not to support multipart uploads")
+	}
+
+	if _, ok := c.(MetadataStore); ok {
+		t.Error("expected a cached fs store not to support metadata")
+	}
+
+	c = NewCachedStore(NewMemStore(), time.Minute, 100)
+	uploads, ok := c.(MultipartStore)
+	if !ok {
+		t.Fatal("expected a cached memory store to support multipart uploads")
+	}
+
+	m, ok := c.(MetadataStore)
+	if !ok {
+		t.Fatal("expected a cached memory store to support metadata")
+	}
+
+	// writes invalidate the cached object
+	if err = m.PutWithMetadata("a.txt", strings.NewReader("a"), map[string]string{checksumMD5: "abc"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := c.Head("a.txt"); err != nil || info.Metadata[checksumMD5] != "abc" {
+		t.Errorf("unexpected object %v: %v", info, err)
+	}
+
+	id, err := uploads.CreateUpload("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = uploadParts(uploads, "a.txt", id, nil, strings.NewReader("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := c.Head("a.txt"); err != nil || info.Size != 3 {
+		t.Errorf("expected the completed upload to replace the cached object, got %v: %v", info, err)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/fclairamb/ftpserver/server"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+)
+
+// the checksums that can be stored with uploads, the names are also their metadata keys
+const (
+	checksumMD5    = "md5"
+	checksumSHA256 = "sha256"
+	checksumCRC32C = "crc32c"
+)
+
+// checksums computes the checksums of the data written to it
+type checksums struct {
+	hashes map[string]hash.Hash
+}
+
+// newChecksums returns a checksums for the algorithms, or nil if there aren't any
+func newChecksums(algorithms []string) *checksums {
+	if len(algorithms) == 0 {
+		return nil
+	}
+
+	c := &checksums{hashes: make(map[string]hash.Hash)}
+	for _, a := range algorithms {
+		c.hashes[a] = newHash(a)
+	}
+
+	return c
+}
+
+func newHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case checksumSHA256:
+		return sha256.New()
+	case checksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	}
+
+	return md5.New()
+}
+
+// newFileHash returns a hash for the HASH command's algorithm and the name of the checksum for it that can be stored
+// with objects, "" if it isn't one of them
+func newFileHash(algorithm server.HashAlgorithm) (hash.Hash, string, error) {
+	switch algorithm {
+	case server.HashMD5:
+		return md5.New(), checksumMD5, nil
+	case server.HashSHA1:
+		return sha1.New(), "", nil
+	case server.HashSHA256:
+		return sha256.New(), checksumSHA256, nil
+	case server.HashCRC32:
+		return crc32.NewIEEE(), "", nil
+	}
+
+	return nil, "", fmt.Errorf("Unsupported hash algorithm: %s", algorithm)
+}
+
+// parseChecksums parses a comma separated list of checksum algorithms, eg: "md5,sha256", or "none"
+func parseChecksums(s string) ([]string, error) {
+	var algorithms []string
+
+	for _, a := range strings.Split(s, ",") {
+		a = strings.ToLower(strings.TrimSpace(a))
+
+		switch a {
+		case "", "none":
+		case checksumMD5, checksumSHA256, checksumCRC32C:
+			algorithms = append(algorithms, a)
+		default:
+			return nil, fmt.Errorf("unknown checksum %s, use %s, %s or %s", a, checksumMD5, checksumSHA256,
+				checksumCRC32C)
+		}
+	}
+
+	return algorithms, nil
+}
+
+func (c *checksums) Write(p []byte) (int, error) {
+	for _, h := range c.hashes {
+		h.Write(p)
+	}
+
+	return len(p), nil
+}
+
+// reader returns r with everything read from it added to the checksums.  c can be nil.
+func (c *checksums) reader(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+
+	return io.TeeReader(r, c)
+}
+
+// metadata returns the checksums in hex, by algorithm
+func (c *checksums) metadata() map[string]string {
+	m := make(map[string]string)
+	for a, h := range c.hashes {
+		m[a] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	return m
+}
+
+// expectedChecksums returns the checksums an object should have, by algorithm: those stored in its metadata and, for
+// an object that wasn't a multipart upload, the MD5 in its ETag
+func expectedChecksums(info *ObjectInfo) map[string]string {
+	expected := make(map[string]string)
+
+	if isMD5ETag(info.ETag) {
+		expected[checksumMD5] = strings.ToLower(info.ETag)
+	}
+
+	for _, a := range []string{checksumMD5, checksumSHA256, checksumCRC32C} {
+		if v := metadataValue(info.Metadata, a); v != "" {
+			expected[a] = strings.ToLower(v)
+		}
+	}
+
+	return expected
+}
+
+// downloadChecksums returns a checksums for verifying a download of the object, or nil if it doesn't have any
+func downloadChecksums(info *ObjectInfo) *checksums {
+	var algorithms []string
+	for a := range expectedChecksums(info) {
+		algorithms = append(algorithms, a)
+	}
+
+	return newChecksums(algorithms)
+}
+
+// verify checks the checksums match those expected for the object
+func (c *checksums) verify(info *ObjectInfo) error {
+	expected := expectedChecksums(info)
+
+	for a, v := range c.metadata() {
+		if want, ok := expected[a]; ok && v != want {
+			return fmt.Errorf("Checksum mismatch for %s: %s is %s but should be %s", info.Key, a, v, want)
+		}
+	}
+
+	return nil
+}
+
+// metadataValue looks up a metadata key ignoring case (S3 returns them with the first letter capitalised)
+func metadataValue(metadata map[string]string, key string) string {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) {
+			return v
+		}
+	}
+
+	return ""
+}
+
+// isMD5ETag returns true if the ETag is an MD5, it isn't for multipart uploads ("<md5 of the part md5s>-<parts>")
+func isMD5ETag(etag string) bool {
+	if len(etag) != md5.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(etag)
+	return err == nil
+}
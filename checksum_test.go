@@ -0,0 +1,69 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseChecksums(t *testing.T) {
+	testCases := []struct {
+		s          string
+		algorithms []string
+		err        bool
+	}{
+		{"md5", []string{"md5"}, false},
+		{"MD5, sha256,crc32c", []string{"md5", "sha256", "crc32c"}, false},
+		{"none", nil, false},
+		{"md5,sha1", nil, true},
+	}
+
+	for _, tc := range testCases {
+		algorithms, err := parseChecksums(tc.s)
+		if (err != nil) != tc.err {
+			t.Errorf("%s: unexpected error %v", tc.s, err)
+		}
+
+		if !tc.err && !reflect.DeepEqual(algorithms, tc.algorithms) {
+			t.Errorf("%s: expected %v got %v", tc.s, tc.algorithms, algorithms)
+		}
+	}
+}
+
+func TestChecksums(t *testing.T) {
+	c := newChecksums([]string{checksumMD5, checksumSHA256, checksumCRC32C})
+	c.Write([]byte("some text"))
+
+	expected := map[string]string{
+		"md5":    "552e21cd4cd9918678e3c1a0df491bc3",
+		"sha256": "b94f6f125c79e3a5ffaa826f584c10d52ada669e6762051b826b55776d05aed2",
+		"crc32c": "2d7d20e7",
+	}
+
+	if m := c.metadata(); !reflect.DeepEqual(m, expected) {
+		t.Errorf("expected %v got %v", expected, m)
+	}
+
+	// S3 returns metadata keys with a capital letter and the ETag has the MD5 for objects that weren't multipart uploads
+	testCases := []struct {
+		info ObjectInfo
+		err  bool
+	}{
+		{ObjectInfo{}, false},
+		{ObjectInfo{ETag: "552e21cd4cd9918678e3c1a0df491bc3"}, false},
+		{ObjectInfo{ETag: "00000000000000000000000000000000"}, true},
+		{ObjectInfo{ETag: "00000000000000000000000000000000-2", Metadata: map[string]string{"Md5": expected["md5"]}}, false},
+		{ObjectInfo{Metadata: map[string]string{"Sha256": strings.ToUpper(expected["sha256"])}}, false},
+		{ObjectInfo{Metadata: map[string]string{"Crc32c": "00000000"}}, true},
+	}
+
+	for i, tc := range testCases {
+		if err := c.verify(&tc.info); (err != nil) != tc.err {
+			t.Errorf("%d: unexpected error %v", i, err)
+		}
+	}
+
+	if downloadChecksums(&ObjectInfo{ETag: "00000000000000000000000000000000-2"}) != nil {
+		t.Error("expected nothing to check a multipart upload without checksum metadata against")
+	}
+}
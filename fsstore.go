@@ -0,0 +1,298 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// fsListPageSize is the maximum number of keys FSStore.List returns at once, the same as S3
+	fsListPageSize = 1000
+	// files are written with a temporary name starting with fsTempPrefix then renamed.  They aren't listed.
+	fsTempPrefix = ".bucketftp-"
+)
+
+// FSStore is an ObjectStore that keeps objects as files under a local directory.  Keys map to paths below the
+// directory so the layout matches the bucket: a directory marker key ("dir/") is a directory and other keys are files.
+// Unlike S3 a key can't be both a file and a directory, and writing a file creates any missing parent directories.
+type FSStore struct {
+	root string
+}
+
+func NewFSStore(root string) (*FSStore, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := os.Stat(root)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening storage directory: %s", err)
+	}
+
+	if !fi.IsDir() {
+		return nil, fmt.Errorf("Error opening storage directory: %s is not a directory", root)
+	}
+
+	return &FSStore{root: root}, nil
+}
+
+// path returns the local path for a key.  Keys can't refer to anything outside the root directory.
+func (s *FSStore) path(key string) (string, error) {
+	p := filepath.Join(s.root, filepath.FromSlash(key))
+
+	if p != s.root && !strings.HasPrefix(p, s.root+string(filepath.Separator)) {
+		return "", fmt.Errorf("Invalid key: %s", key)
+	}
+
+	return p, nil
+}
+
+// key returns the key for a local path below the root directory
+func (s *FSStore) key(p string, isDir bool) (string, error) {
+	rel, err := filepath.Rel(s.root, p)
+	if err != nil {
+		return "", err
+	}
+
+	key := filepath.ToSlash(rel)
+	if isDir {
+		key += "/"
+	}
+
+	return key, nil
+}
+
+func (s *FSStore) List(prefix, delimiter, continuationToken string) (*ObjectList, error) {
+	// only the directory holding prefix needs to be searched, eg: "dir/sub" and "dir/" are both in "dir"
+	base, err := s.path(prefix[:strings.LastIndex(prefix, "/")+1])
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []ObjectInfo
+
+	err = filepath.Walk(base, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			// a prefix that doesn't exist has no objects
+			if os.IsNotExist(err) && p == base {
+				return nil
+			}
+			return err
+		}
+
+		// the root directory doesn't have a marker
+		if p == s.root {
+			return nil
+		}
+
+		if !fi.IsDir() && strings.HasPrefix(fi.Name(), fsTempPrefix) {
+			return nil
+		}
+
+		key, err := s.key(p, fi.IsDir())
+		if err != nil {
+			return err
+		}
+
+		if fi.IsDir() && p != base {
+			// skip directories that can't contain matching keys and, when listing with a delimiter, anything below the
+			// first level (it would be rolled up into the directory's common prefix)
+			if !strings.HasPrefix(key, prefix) && !strings.HasPrefix(prefix, key) {
+				return filepath.SkipDir
+			}
+
+			if delimiter == "/" && strings.HasPrefix(key, prefix) {
+				objects = append(objects, ObjectInfo{Key: key, LastModified: fi.ModTime()})
+				return filepath.SkipDir
+			}
+		}
+
+		info := ObjectInfo{Key: key, LastModified: fi.ModTime()}
+		if !fi.IsDir() {
+			info.Size = fi.Size()
+		}
+		objects = append(objects, info)
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// directory markers sort differently to the walk order, eg: "a.txt" comes before "a/"
+	sort.Sort(objectsByKey(objects))
+
+	return listPage(objects, prefix, delimiter, continuationToken, fsListPageSize), nil
+}
+
+func (s *FSStore) Head(key string) (*ObjectInfo, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	isDir := strings.HasSuffix(key, "/")
+
+	fi, err := os.Stat(p)
+	if err != nil || fi.IsDir() != isDir || p == s.root {
+		return nil, errNoSuchKey{key: key}
+	}
+
+	info := &ObjectInfo{Key: key, LastModified: fi.ModTime()}
+	if !isDir {
+		info.Size = fi.Size()
+	}
+
+	return info, nil
+}
+
+func (s *FSStore) Get(key string, offset int64) (io.ReadCloser, *ObjectInfo, error) {
+	info, err := s.Head(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if offset < 0 || offset > info.Size {
+		return nil, nil, errInvalidOffset
+	}
+
+	if strings.HasSuffix(key, "/") {
+		return ioutil.NopCloser(strings.NewReader("")), info, nil
+	}
+
+	p, err := s.path(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err = f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	return f, info, nil
+}
+
+func (s *FSStore) Put(key string, body io.Reader) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if p == s.root {
+		return fmt.Errorf("Invalid key: %s", key)
+	}
+
+	if strings.HasSuffix(key, "/") {
+		// directory markers are empty
+		if _, err = io.Copy(ioutil.Discard, body); err != nil {
+			return err
+		}
+
+		return os.MkdirAll(p, 0755)
+	}
+
+	if fi, err := os.Stat(p); err == nil && fi.IsDir() {
+		return fmt.Errorf("Cannot write %s: it is a directory", key)
+	}
+
+	if err = os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file and rename it into place, so the old file is replaced in one go and can still be read
+	// while the new one is written (eg: when appending to it)
+	f, err := ioutil.TempFile(filepath.Dir(p), fsTempPrefix)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(f, body); err == nil {
+		if err = f.Chmod(0644); err == nil {
+			err = f.Close()
+		}
+	}
+
+	if err == nil {
+		err = os.Rename(f.Name(), p)
+	}
+
+	if err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (s *FSStore) Copy(srcKey, dstKey string, size int64) error {
+	if strings.HasSuffix(srcKey, "/") != strings.HasSuffix(dstKey, "/") {
+		return errors.New("Cannot copy between a file and a directory")
+	}
+
+	body, _, err := s.Get(srcKey, 0)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	return s.Put(dstKey, body)
+}
+
+func (s *FSStore) Delete(keys []string) error {
+	// files first then directories, deepest first, so directories are empty by the time they're removed
+	var files, dirs []string
+	for _, key := range keys {
+		if strings.HasSuffix(key, "/") {
+			dirs = append(dirs, key)
+		} else {
+			files = append(files, key)
+		}
+	}
+
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+
+	for _, key := range append(files, dirs...) {
+		p, err := s.path(key)
+		if err != nil {
+			return err
+		}
+
+		if p == s.root {
+			continue
+		}
+
+		if strings.HasSuffix(key, "/") {
+			// S3 can delete a directory marker and leave the keys below it but a directory that isn't empty has to stay
+			entries, err := ioutil.ReadDir(p)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+
+			if len(entries) > 0 {
+				continue
+			}
+		}
+
+		if err = os.Remove(p); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var _ ObjectStore = &FSStore{}
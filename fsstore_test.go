@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFSStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucketftp-fsstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var s *FSStore
+	if s, err = NewFSStore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"dir/", "dir/a.txt", "dir/sub/", "dir/sub/b.txt", "dir.txt", "top.txt"} {
+		if err = s.Put(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an upload in progress isn't listed
+	if err = ioutil.WriteFile(filepath.Join(dir, "dir", fsTempPrefix+"123"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// objects are files and directory markers are directories
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "dir", "sub", "b.txt")); err != nil || string(b) != "dir/sub/b.txt" {
+		t.Errorf("unexpected file contents %q: %v", b, err)
+	}
+
+	if fi, err := os.Stat(filepath.Join(dir, "dir", "sub")); err != nil || !fi.IsDir() {
+		t.Errorf("expected a directory for dir/sub/: %v", err)
+	}
+
+	testCases := []struct {
+		prefix, delimiter string
+		objects, prefixes []string
+	}{
+		{"", "/", []string{"dir.txt", "top.txt"}, []string{"dir/"}},
+		{"dir/", "/", []string{"dir/", "dir/a.txt"}, []string{"dir/sub/"}},
+		{"dir", "/", []string{"dir.txt"}, []string{"dir/"}},
+		{"dir/", "", []string{"dir/", "dir/a.txt", "dir/sub/", "dir/sub/b.txt"}, nil},
+		{"dir/sub/b", "", []string{"dir/sub/b.txt"}, nil},
+		{"missing/", "/", nil, nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.prefix+" "+tc.delimiter, func(t *testing.T) {
+			list, err := s.List(tc.prefix, tc.delimiter, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var objects []string
+			for _, o := range list.Objects {
+				objects = append(objects, o.Key)
+			}
+
+			if !reflect.DeepEqual(objects, tc.objects) {
+				t.Errorf("expected objects %v got %v", tc.objects, objects)
+			}
+
+			if !reflect.DeepEqual(list.CommonPrefixes, tc.prefixes) {
+				t.Errorf("expected common prefixes %v got %v", tc.prefixes, list.CommonPrefixes)
+			}
+		})
+	}
+
+	os.Remove(filepath.Join(dir, "dir", fsTempPrefix+"123"))
+
+	// a file isn't a directory and vice versa
+	for _, key := range []string{"dir", "dir.txt/", "missing.txt", "", "../outside.txt"} {
+		if _, _, err = s.Get(key, 0); err == nil {
+			t.Errorf("expected an error getting %q", key)
+		}
+	}
+
+	if err = s.Copy("dir/a.txt", "copy.txt", 9); err != nil {
+		t.Fatal(err)
+	}
+
+	body, info, err := s.Get("copy.txt", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	buf.ReadFrom(body)
+	body.Close()
+
+	if buf.String() != "dir/a.txt" || info.Size != int64(buf.Len()) {
+		t.Errorf("unexpected copy %q size %d", buf.String(), info.Size)
+	}
+
+	// deleting everything below dir/ in any order removes the directories too
+	if err = s.Delete([]string{"dir/", "dir/sub/", "dir/a.txt", "dir/sub/b.txt", "dir/missing.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "dir")); !os.IsNotExist(err) {
+		t.Errorf("expected dir to be deleted: %v", err)
+	}
+}
+
+func TestListPage(t *testing.T) {
+	var objects []ObjectInfo
+	for _, key := range []string{"a.txt", "b/", "b/1", "b/2", "c.txt", "d/1", "e.txt"} {
+		objects = append(objects, ObjectInfo{Key: key})
+	}
+
+	// page through two at a time, directories count as one
+	var pages [][]string
+	var token string
+	for {
+		list := listPage(objects, "", "/", token, 2)
+
+		var page []string
+		for _, o := range list.Objects {
+			page = append(page, o.Key)
+		}
+		page = append(page, list.CommonPrefixes...)
+		pages = append(pages, page)
+
+		if list.NextContinuationToken == "" {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+
+	expected := [][]string{{"a.txt", "b/"}, {"c.txt", "d/"}, {"e.txt"}}
+	if !reflect.DeepEqual(pages, expected) {
+		t.Errorf("expected pages %v got %v", expected, pages)
+	}
+}
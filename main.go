@@ -1,53 +1,252 @@
 package main
 
 import (
-	"github.com/aws/aws-sdk-go/aws/session"
+	"bufio"
+	"crypto/x509"
+	"flag"
+	"fmt"
 	"github.com/fclairamb/ftpserver/server"
 	"log"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 )
 
 var (
-	ftpServer      *server.FtpServer
-	driver         *S3Driver
-	FTP_PORT_STR   = os.Getenv("FTP_PORT")
-	FTP_PORT       int
-	S3_BUCKET_NAME = os.Getenv("S3_BUCKET_NAME")
-	ROOT_PREFIX    = os.Getenv("ROOT_PREFIX")
-	FTP_USER       = os.Getenv("FTP_USER")
-	FTP_PASSWD     = os.Getenv("FTP_PASSWD")
+	ftpServer    *server.FtpServer
+	driver       *S3Driver
+	certs        *certStore
+	cache        Cache
+	FTP_PORT_STR = os.Getenv("FTP_PORT")
+	FTP_PORT     int
+	// where files are stored: "s3" (the default), "fs" for a local directory or "memory" (lost on exit, for testing)
+	STORAGE_BACKEND = os.Getenv("STORAGE_BACKEND")
+	STORAGE_DIR     = os.Getenv("STORAGE_DIR")
+	S3_BUCKET_NAME  = os.Getenv("S3_BUCKET_NAME")
+	// for S3 compatible stores, eg: MinIO.  The region defaults to AWS_REGION.
+	S3_ENDPOINT             = os.Getenv("S3_ENDPOINT")
+	S3_REGION               = os.Getenv("S3_REGION")
+	S3_FORCE_PATH_STYLE_STR = os.Getenv("S3_FORCE_PATH_STYLE")
+	S3_FORCE_PATH_STYLE     bool
+	S3_DISABLE_SSL_STR      = os.Getenv("S3_DISABLE_SSL")
+	S3_DISABLE_SSL          bool
+	S3_CA_BUNDLE            = os.Getenv("S3_CA_BUNDLE")
+	ROOT_PREFIX             = os.Getenv("ROOT_PREFIX")
+	FTP_USER                = os.Getenv("FTP_USER")
+	FTP_PASSWD              = os.Getenv("FTP_PASSWD")
+	USERS_FILE              = os.Getenv("USERS_FILE")
+	TLS_CERT_FILE           = os.Getenv("TLS_CERT_FILE")
+	TLS_KEY_FILE            = os.Getenv("TLS_KEY_FILE")
+	// look up each directory's timestamp when listing, one request per directory.  Otherwise they're listed without one.
+	LIST_DIR_MOD_TIMES_STR = os.Getenv("LIST_DIR_MOD_TIMES")
+	LIST_DIR_MOD_TIMES     bool
+	// treat prefixes without a directory marker object as directories
+	IMPLICIT_DIRS_STR = os.Getenv("IMPLICIT_DIRS")
+	IMPLICIT_DIRS     bool
+	// how long to cache object metadata and listings, eg: "30s".  Unset or 0 disables the cache.
+	CACHE_TTL_STR  = os.Getenv("CACHE_TTL")
+	CACHE_TTL      time.Duration
+	CACHE_SIZE_STR = os.Getenv("CACHE_SIZE")
+	CACHE_SIZE     = 10000 // the maximum number of cached entries
+	// keep interrupted uploads so clients can resume them with REST and STOR (s3 and memory backends only)
+	UPLOAD_RESUME_STR = os.Getenv("UPLOAD_RESUME")
+	UPLOAD_RESUME     bool
+	// how long an interrupted upload is kept before it's aborted, eg: "24h".  0 keeps them until they're resumed.
+	UPLOAD_MAX_AGE_STR = os.Getenv("UPLOAD_MAX_AGE")
+	UPLOAD_MAX_AGE     = 24 * time.Hour
+	// checksums to compute for uploads and store with them, eg: "md5,sha256".  Downloads are checked against them.
+	CHECKSUMS_STR = os.Getenv("CHECKSUMS")
+	CHECKSUMS     = []string{checksumMD5}
+	// CA certificates for verifying TLS client certificates.  Leave unset to disable client certificate logins.
+	TLS_CLIENT_CA_FILE = os.Getenv("TLS_CLIENT_CA_FILE")
+	// how often to check the TLS cert and key files for changes, eg: "1m".  0 disables checking (use SIGHUP instead)
+	TLS_RELOAD_INTERVAL_STR = os.Getenv("TLS_RELOAD_INTERVAL")
+	TLS_RELOAD_INTERVAL     = time.Minute
 )
 
-func init() {
-	switch "" {
-	case FTP_PORT_STR:
+// checkEnv validates the environment variables needed to run the server.  It isn't called for subcommands such as
+// hash-password.
+func checkEnv() {
+	if FTP_PORT_STR == "" {
 		log.Fatal("Error: environment variable FTP_PORT is not set")
-	case S3_BUCKET_NAME:
-		log.Fatal("Error: environment variable S3_BUCKET_NAME is not set")
-	case FTP_USER:
-		log.Fatal("Error: environment variable FTP_USER is not set")
-	case FTP_PASSWD:
-		log.Fatal("Error: environment variable FTP_PASSWD is not set")
+	}
+
+	switch STORAGE_BACKEND {
+	case "", "s3":
+		if S3_BUCKET_NAME == "" {
+			log.Fatal("Error: environment variable S3_BUCKET_NAME is not set")
+		}
+	case "fs":
+		if STORAGE_DIR == "" {
+			log.Fatal("Error: environment variable STORAGE_DIR is not set")
+		}
+	case "memory":
+	default:
+		log.Fatal("Error: environment variable STORAGE_BACKEND must be s3, fs or memory")
+	}
+
+	// a single user from FTP_USER and FTP_PASSWD is only needed without a users file
+	if USERS_FILE == "" {
+		switch "" {
+		case FTP_USER:
+			log.Fatal("Error: environment variable FTP_USER is not set (or set USERS_FILE)")
+		case FTP_PASSWD:
+			log.Fatal("Error: environment variable FTP_PASSWD is not set (or set USERS_FILE)")
+		}
+	}
+
+	if (TLS_CERT_FILE == "") != (TLS_KEY_FILE == "") {
+		log.Fatal("Error: environment variables TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+
+	if TLS_CLIENT_CA_FILE != "" && TLS_CERT_FILE == "" {
+		log.Fatal("Error: environment variable TLS_CLIENT_CA_FILE needs TLS_CERT_FILE and TLS_KEY_FILE to be set")
 	}
 
 	var err error
 	if FTP_PORT, err = strconv.Atoi(FTP_PORT_STR); err != nil {
 		log.Fatal("Error parsing FTP_PORT as an integer", err)
 	}
+
+	if S3_FORCE_PATH_STYLE_STR != "" {
+		if S3_FORCE_PATH_STYLE, err = strconv.ParseBool(S3_FORCE_PATH_STYLE_STR); err != nil {
+			log.Fatal("Error parsing S3_FORCE_PATH_STYLE as a boolean", err)
+		}
+	}
+
+	if S3_DISABLE_SSL_STR != "" {
+		if S3_DISABLE_SSL, err = strconv.ParseBool(S3_DISABLE_SSL_STR); err != nil {
+			log.Fatal("Error parsing S3_DISABLE_SSL as a boolean", err)
+		}
+	}
+
+	if LIST_DIR_MOD_TIMES_STR != "" {
+		if LIST_DIR_MOD_TIMES, err = strconv.ParseBool(LIST_DIR_MOD_TIMES_STR); err != nil {
+			log.Fatal("Error parsing LIST_DIR_MOD_TIMES as a boolean", err)
+		}
+	}
+
+	if IMPLICIT_DIRS_STR != "" {
+		if IMPLICIT_DIRS, err = strconv.ParseBool(IMPLICIT_DIRS_STR); err != nil {
+			log.Fatal("Error parsing IMPLICIT_DIRS as a boolean", err)
+		}
+	}
+
+	if CACHE_TTL_STR != "" {
+		if CACHE_TTL, err = time.ParseDuration(CACHE_TTL_STR); err != nil {
+			log.Fatal("Error parsing CACHE_TTL as a duration", err)
+		}
+	}
+
+	if CACHE_SIZE_STR != "" {
+		if CACHE_SIZE, err = strconv.Atoi(CACHE_SIZE_STR); err != nil || CACHE_SIZE < 1 {
+			log.Fatal("Error parsing CACHE_SIZE as a positive integer", err)
+		}
+	}
+
+	if UPLOAD_RESUME_STR != "" {
+		if UPLOAD_RESUME, err = strconv.ParseBool(UPLOAD_RESUME_STR); err != nil {
+			log.Fatal("Error parsing UPLOAD_RESUME as a boolean", err)
+		}
+	}
+
+	if UPLOAD_MAX_AGE_STR != "" {
+		if UPLOAD_MAX_AGE, err = time.ParseDuration(UPLOAD_MAX_AGE_STR); err != nil {
+			log.Fatal("Error parsing UPLOAD_MAX_AGE as a duration", err)
+		}
+	}
+
+	if CHECKSUMS_STR != "" {
+		if CHECKSUMS, err = parseChecksums(CHECKSUMS_STR); err != nil {
+			log.Fatal("Error parsing CHECKSUMS", err)
+		}
+	}
+
+	if TLS_RELOAD_INTERVAL_STR != "" {
+		if TLS_RELOAD_INTERVAL, err = time.ParseDuration(TLS_RELOAD_INTERVAL_STR); err != nil {
+			log.Fatal("Error parsing TLS_RELOAD_INTERVAL as a duration", err)
+		}
+	}
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "hash-password" {
+		hashPasswordCommand(os.Args[2:])
+		return
+	}
+
+	checkEnv()
+
 	var err error
 
-	var s3Session *session.Session
-	if s3Session, err = session.NewSession(); err != nil {
-		log.Fatal("error creating S3 session", err)
+	var store ObjectStore
+	if store, err = newObjectStore(); err != nil {
+		log.Fatal(err)
+	}
+
+	var uploads MultipartStore
+	if UPLOAD_RESUME {
+		var ok bool
+		if uploads, ok = store.(MultipartStore); !ok {
+			log.Fatal("Error: UPLOAD_RESUME isn't supported by the " + STORAGE_BACKEND + " storage backend")
+		}
+	}
+
+	if CACHE_TTL > 0 {
+		cache = NewCachedStore(store, CACHE_TTL, CACHE_SIZE)
+		store = cache
+
+		if uploads != nil {
+			uploads = cache.(MultipartStore)
+		}
+	}
+
+	var users *UserStore
+	if USERS_FILE != "" {
+		users, err = LoadUserStore(USERS_FILE)
+	} else {
+		users, err = NewUserStore(&User{Name: FTP_USER, Password: FTP_PASSWD})
 	}
+	if err != nil {
+		log.Fatal("error loading users", err)
+	}
+
+	driver = NewS3Driver(store, ROOT_PREFIX, FTP_PORT, users)
+	driver.dirModTimes = LIST_DIR_MOD_TIMES
+	driver.implicitDirs = IMPLICIT_DIRS
+	driver.uploads = uploads
+	driver.checksums = CHECKSUMS
+
+	if uploads != nil && UPLOAD_MAX_AGE > 0 {
+		interval := time.Hour
+		if UPLOAD_MAX_AGE < interval {
+			interval = UPLOAD_MAX_AGE
+		}
+
+		go watchUploads(uploads, ROOT_PREFIX, UPLOAD_MAX_AGE, interval)
+	}
+
+	if TLS_CERT_FILE != "" {
+		if certs, err = newCertStore(TLS_CERT_FILE, TLS_KEY_FILE); err != nil {
+			log.Fatal(err)
+		}
+
+		var clientCAs *x509.CertPool
+		if TLS_CLIENT_CA_FILE != "" {
+			if clientCAs, err = loadCertPool(TLS_CLIENT_CA_FILE); err != nil {
+				log.Fatal(err)
+			}
+		}
 
-	driver = NewS3Driver(s3Session, S3_BUCKET_NAME, ROOT_PREFIX, FTP_PORT, FTP_USER, FTP_PASSWD)
+		driver.tlsConfig = newTLSConfig(certs, clientCAs)
+
+		if TLS_RELOAD_INTERVAL > 0 {
+			go certs.watch(TLS_RELOAD_INTERVAL)
+		}
+	}
 	ftpServer = server.NewFtpServer(driver)
 
 	go signalHandler()
@@ -57,14 +256,80 @@ func main() {
 	}
 }
 
+// newObjectStore returns the storage backend selected by STORAGE_BACKEND
+func newObjectStore() (ObjectStore, error) {
+	switch STORAGE_BACKEND {
+	case "fs":
+		return NewFSStore(STORAGE_DIR)
+	case "memory":
+		return NewMemStore(), nil
+	}
+
+	s3Session, err := newS3Session(S3Config{
+		Endpoint:       S3_ENDPOINT,
+		Region:         S3_REGION,
+		ForcePathStyle: S3_FORCE_PATH_STYLE,
+		DisableSSL:     S3_DISABLE_SSL,
+		CABundle:       S3_CA_BUNDLE,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return NewS3Store(s3Session, S3_BUCKET_NAME), nil
+}
+
 func signalHandler() {
-	ch := make(chan os.Signal)
-	signal.Notify(ch, syscall.SIGTERM)
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 	for {
 		switch <-ch {
 		case syscall.SIGTERM:
 			ftpServer.Stop()
 			break
+		case syscall.SIGHUP:
+			// re-read the users file and TLS certificate so they can be changed without a restart
+			if err := driver.users.Reload(); err != nil {
+				log.Println("error reloading users", err)
+			}
+
+			if certs != nil {
+				if err := certs.Reload(); err != nil {
+					log.Println("error reloading TLS certificate", err)
+				}
+			}
+		case syscall.SIGUSR1:
+			if cache != nil {
+				hits, misses, entries := cache.Stats()
+				log.Printf("cache: %d hits, %d misses, %d entries", hits, misses, entries)
+			}
 		}
 	}
 }
+
+// hashPasswordCommand implements "bucketFTP hash-password [-algorithm bcrypt|argon2id]".  It reads a password from
+// stdin and prints a hash suitable for the password_hash field in the users file.
+func hashPasswordCommand(args []string) {
+	flags := flag.NewFlagSet("hash-password", flag.ExitOnError)
+	algorithm := flags.String("algorithm", hashBcrypt, "password hash algorithm: "+hashBcrypt+" or "+hashArgon2id)
+	flags.Parse(args)
+
+	fmt.Fprint(os.Stderr, "Password: ")
+
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		log.Fatal("Error reading password from stdin: ", err)
+	}
+
+	password = strings.TrimRight(password, "\r\n")
+	if password == "" {
+		log.Fatal("Error: empty password")
+	}
+
+	var hash string
+	if hash, err = hashPassword(*algorithm, password); err != nil {
+		log.Fatal("Error hashing password: ", err)
+	}
+
+	fmt.Println(hash)
+}
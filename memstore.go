@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memListPageSize is the page size for new MemStores, the same as S3.  Tests make it smaller to exercise pagination.
+var memListPageSize = 1000
+
+// MemStore is an ObjectStore that keeps objects in memory with the same semantics as S3 (flat keys, prefix and
+// delimiter listing, pagination).  Objects are lost when the server stops so it's mostly useful for tests.
+type MemStore struct {
+	mu       sync.RWMutex
+	objects  map[string]memObject
+	uploads  map[string]*memUpload // by upload id
+	lastID   int
+	pageSize int // the maximum number of keys List returns at once
+}
+
+type memObject struct {
+	data     []byte
+	modTime  time.Time
+	etag     string
+	metadata map[string]string
+}
+
+func newMemObject(data []byte, metadata map[string]string) memObject {
+	sum := md5.Sum(data)
+	return memObject{data: data, modTime: time.Now().UTC(), etag: hex.EncodeToString(sum[:]), metadata: metadata}
+}
+
+func (o memObject) info(key string) *ObjectInfo {
+	info := &ObjectInfo{Key: key, Size: int64(len(o.data)), LastModified: o.modTime, ETag: o.etag}
+
+	// a copy, changing it shouldn't change the object
+	if o.metadata != nil {
+		info.Metadata = make(map[string]string)
+		for k, v := range o.metadata {
+			info.Metadata[k] = v
+		}
+	}
+
+	return info
+}
+
+type memUpload struct {
+	key       string
+	initiated time.Time
+	parts     map[int][]byte
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{
+		objects:  make(map[string]memObject),
+		uploads:  make(map[string]*memUpload),
+		pageSize: memListPageSize,
+	}
+}
+
+func (s *MemStore) List(prefix, delimiter, continuationToken string) (*ObjectList, error) {
+	s.mu.RLock()
+	objects := make([]ObjectInfo, 0, len(s.objects))
+	for key, o := range s.objects {
+		objects = append(objects, ObjectInfo{Key: key, Size: int64(len(o.data)), LastModified: o.modTime})
+	}
+	s.mu.RUnlock()
+
+	sort.Sort(objectsByKey(objects))
+
+	return listPage(objects, prefix, delimiter, continuationToken, s.pageSize), nil
+}
+
+func (s *MemStore) Head(key string) (*ObjectInfo, error) {
+	s.mu.RLock()
+	o, ok := s.objects[key]
+	s.mu.RUnlock()
+
+	if !ok {
+		return nil, errNoSuchKey{key: key}
+	}
+
+	return o.info(key), nil
+}
+
+func (s *MemStore) Get(key string, offset int64) (io.ReadCloser, *ObjectInfo, error) {
+	s.mu.RLock()
+	o, ok := s.objects[key]
+	s.mu.RUnlock()
+
+	if !ok {
+		return nil, nil, errNoSuchKey{key: key}
+	}
+
+	if offset < 0 || offset > int64(len(o.data)) {
+		return nil, nil, errInvalidOffset
+	}
+
+	// the data is never modified after it's stored so can be shared with the reader
+	return ioutil.NopCloser(bytes.NewReader(o.data[offset:])), o.info(key), nil
+}
+
+func (s *MemStore) Put(key string, body io.Reader) error {
+	return s.PutWithMetadata(key, body, nil)
+}
+
+func (s *MemStore) PutWithMetadata(key string, body io.Reader, metadata map[string]string) error {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.objects[key] = newMemObject(data, metadata)
+	s.mu.Unlock()
+
+	return nil
+}
+
+func (s *MemStore) Copy(srcKey, dstKey string, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.objects[srcKey]
+	if !ok {
+		return errNoSuchKey{key: srcKey}
+	}
+
+	// like S3 the copy has the same metadata
+	s.objects[dstKey] = newMemObject(o.data, o.metadata)
+
+	return nil
+}
+
+func (s *MemStore) Delete(keys []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, key := range keys {
+		delete(s.objects, key)
+	}
+
+	return nil
+}
+
+func (s *MemStore) Uploads(prefix string) ([]Upload, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var uploads []Upload
+	for id, u := range s.uploads {
+		if strings.HasPrefix(u.key, prefix) {
+			uploads = append(uploads, Upload{Key: u.key, ID: id, Initiated: u.initiated})
+		}
+	}
+
+	return uploads, nil
+}
+
+func (s *MemStore) CreateUpload(key string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lastID++
+	id := strconv.Itoa(s.lastID)
+	s.uploads[id] = &memUpload{key: key, initiated: time.Now().UTC(), parts: make(map[int][]byte)}
+
+	return id, nil
+}
+
+func (s *MemStore) UploadPart(key, uploadID string, partNumber int, body io.ReadSeeker) (string, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return "", err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.upload(key, uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	u.parts[partNumber] = data
+
+	return partETag(data), nil
+}
+
+func (s *MemStore) CopyPart(key, uploadID string, partNumber int, srcKey string, offset, size int64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.upload(key, uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	o, ok := s.objects[srcKey]
+	if !ok {
+		return "", errNoSuchKey{key: srcKey}
+	}
+
+	if offset < 0 || size < 0 || offset+size > int64(len(o.data)) {
+		return "", errInvalidOffset
+	}
+
+	data := o.data[offset : offset+size]
+	u.parts[partNumber] = data
+
+	return partETag(data), nil
+}
+
+func (s *MemStore) Parts(key, uploadID string) ([]Part, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	u, err := s.upload(key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	var parts []Part
+	for n, data := range u.parts {
+		parts = append(parts, Part{Number: n, Size: int64(len(data)), ETag: partETag(data)})
+	}
+
+	sort.Sort(partsByNumber(parts))
+
+	return parts, nil
+}
+
+func (s *MemStore) CompleteUpload(key, uploadID string, parts []Part) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	u, err := s.upload(key, uploadID)
+	if err != nil {
+		return "", err
+	}
+
+	// like S3 the object is only made from the parts listed, which must be in order
+	var data, partSums []byte
+	for i, p := range parts {
+		part, ok := u.parts[p.Number]
+		if !ok || p.ETag != partETag(part) || (i > 0 && p.Number <= parts[i-1].Number) {
+			return "", errInvalidPart
+		}
+
+		data = append(data, part...)
+
+		sum := md5.Sum(part)
+		partSums = append(partSums, sum[:]...)
+	}
+
+	// like S3 the ETag isn't the MD5 of the object
+	o := newMemObject(data, nil)
+	o.etag = multipartETag(partSums)
+
+	s.objects[key] = o
+	delete(s.uploads, uploadID)
+
+	return o.etag, nil
+}
+
+func (s *MemStore) AbortUpload(key, uploadID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := s.upload(key, uploadID); err != nil {
+		return err
+	}
+
+	delete(s.uploads, uploadID)
+
+	return nil
+}
+
+// partETag returns the ETag of a part, its MD5
+func partETag(data []byte) string {
+	sum := md5.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// upload returns an upload that hasn't been completed or aborted.  s.mu must be held.
+func (s *MemStore) upload(key, uploadID string) (*memUpload, error) {
+	u, ok := s.uploads[uploadID]
+	if !ok || u.key != key {
+		return nil, errNoSuchUpload
+	}
+
+	return u, nil
+}
+
+var _ ObjectStore = &MemStore{}
+var _ MultipartStore = &MemStore{}
+var _ MetadataStore = &MemStore{}
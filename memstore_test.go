@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMemStore(t *testing.T) {
+	s := NewMemStore()
+	s.pageSize = 2
+
+	for _, key := range []string{"dir/", "dir/a.txt", "dir/b.txt", "dir/sub/", "dir/sub/c.txt", "dir.txt"} {
+		if err := s.Put(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// page through the recursive listing
+	var keys []string
+	var token string
+	for {
+		list, err := s.List("dir/", "", token)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(list.Objects) > 2 {
+			t.Errorf("expected at most 2 objects in a page, got %d", len(list.Objects))
+		}
+
+		for _, o := range list.Objects {
+			keys = append(keys, o.Key)
+		}
+
+		if list.NextContinuationToken == "" {
+			break
+		}
+		token = list.NextContinuationToken
+	}
+
+	expected := []string{"dir/", "dir/a.txt", "dir/b.txt", "dir/sub/", "dir/sub/c.txt"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected keys %v got %v", expected, keys)
+	}
+
+	if err := s.Copy("dir/a.txt", "copy.txt", 9); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Copy("missing.txt", "copy.txt", 0); err == nil {
+		t.Error("expected an error copying a missing object")
+	}
+
+	body, info, err := s.Get("copy.txt", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := ioutil.ReadAll(body)
+	body.Close()
+
+	if string(b) != "dir/a.txt" || info.Size != int64(len(b)) {
+		t.Errorf("unexpected copy %q size %d", b, info.Size)
+	}
+
+	if err = s.Delete([]string{"dir/a.txt", "copy.txt", "missing.txt"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"dir/a.txt", "copy.txt"} {
+		if _, _, err = s.Get(key, 0); err == nil {
+			t.Errorf("expected %s to be deleted", key)
+		}
+	}
+}
+
+func TestMemStoreMultipart(t *testing.T) {
+	s := NewMemStore()
+
+	id, err := s.CreateUpload("dir/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// parts can arrive in any order
+	for _, p := range []struct {
+		n    int
+		data string
+	}{{2, "world"}, {1, "hello "}} {
+		etag, err := s.UploadPart("dir/a.txt", id, p.n, strings.NewReader(p.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if sum := md5.Sum([]byte(p.data)); etag != hex.EncodeToString(sum[:]) {
+			t.Errorf("part %d: expected the MD5 as the ETag, got %s", p.n, etag)
+		}
+	}
+
+	parts, err := s.Parts("dir/a.txt", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(parts, []Part{{Number: 1, Size: 6, ETag: "f814893777bcc2295fff05f00e508da6"},
+		{Number: 2, Size: 5, ETag: "7d793037a0760186574b0282f2f435e7"}}) {
+		t.Errorf("unexpected parts %v", parts)
+	}
+
+	// the upload isn't an object until it's completed
+	if _, err = s.Head("dir/a.txt"); err == nil {
+		t.Error("expected the object not to exist before the upload is completed")
+	}
+
+	if uploads, err := s.Uploads("dir/"); err != nil || len(uploads) != 1 || uploads[0].Key != "dir/a.txt" {
+		t.Errorf("unexpected uploads %v: %v", uploads, err)
+	}
+
+	if _, err = s.UploadPart("dir/b.txt", id, 3, strings.NewReader("x")); err != errNoSuchUpload {
+		t.Errorf("expected an error uploading a part with the wrong key, got: %v", err)
+	}
+
+	// the parts must have the ETags they were uploaded with
+	wrong := []Part{parts[0], {Number: 2, Size: 5, ETag: parts[0].ETag}}
+	if _, err = s.CompleteUpload("dir/a.txt", id, wrong); err != errInvalidPart {
+		t.Errorf("expected an invalid part error, got: %v", err)
+	}
+
+	if _, err = s.Head("dir/a.txt"); err == nil {
+		t.Error("expected the object not to exist after a failed completion")
+	}
+
+	etag, err := s.CompleteUpload("dir/a.txt", id, parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if etag != partsETag(parts) || !strings.HasSuffix(etag, "-2") {
+		t.Errorf("unexpected multipart ETag %s", etag)
+	}
+
+	body, _, err := s.Get("dir/a.txt", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := ioutil.ReadAll(body)
+	body.Close()
+
+	if string(b) != "hello world" {
+		t.Errorf("unexpected object %q", b)
+	}
+
+	if uploads, err := s.Uploads(""); err != nil || len(uploads) != 0 {
+		t.Errorf("expected no uploads after completing, got %v: %v", uploads, err)
+	}
+
+	if id, err = s.CreateUpload("dir/c.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.AbortUpload("dir/c.txt", id); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.CompleteUpload("dir/c.txt", id, nil); err != errNoSuchUpload {
+		t.Errorf("expected an aborted upload to be gone, got: %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"io"
+	"strings"
+	"time"
+)
+
+// ObjectStore is the storage S3Driver and S3VirtualFile are built on.  It's a narrow subset of the S3 API so that other
+// backends (or an in-process fake) can be used in place of S3.  Keys follow the layout used by the driver: a directory
+// is a zero byte object whose key has a trailing slash, eg: "dir/" and "dir/file.txt".
+type ObjectStore interface {
+	// List returns a page of the objects with keys starting with prefix, in key order.  With a delimiter, keys that
+	// contain the delimiter after the prefix are rolled up into CommonPrefixes (like S3's ListObjectsV2).  Pass the
+	// NextContinuationToken from the previous page to get the next page.
+	List(prefix, delimiter, continuationToken string) (*ObjectList, error)
+
+	// Head returns an object's metadata without reading it
+	Head(key string) (*ObjectInfo, error)
+
+	// Get opens an object for reading from offset bytes in (eg: to resume a download).  The returned ObjectInfo has
+	// the size of the whole object.  The caller must close the returned body.
+	Get(key string, offset int64) (io.ReadCloser, *ObjectInfo, error)
+
+	// Put creates or replaces an object with the contents of body, reading until io.EOF
+	Put(key string, body io.Reader) error
+
+	// Copy copies an object to a new key.  size is the size of the source object (from List or Head), which lets the
+	// store pick how to copy it.
+	Copy(srcKey, dstKey string, size int64) error
+
+	// Delete removes the objects.  Keys that don't exist are ignored.  If some of the objects couldn't be deleted the
+	// error is a DeleteErrors listing them.
+	Delete(keys []string) error
+}
+
+// MultipartStore is implemented by stores that can build an object from parts uploaded separately, so an upload that
+// was interrupted can be continued later (REST then STOR).  Like S3, every part except the last should be at least 5MB.
+type MultipartStore interface {
+	// Uploads returns the uploads with keys starting with prefix that haven't been completed or aborted
+	Uploads(prefix string) ([]Upload, error)
+
+	// CreateUpload starts an upload to key and returns its id
+	CreateUpload(key string) (string, error)
+
+	// UploadPart stores a part of an upload and returns its ETag.  Parts are numbered from 1 and make up the object in
+	// number order.  It fails if the part isn't stored intact.
+	UploadPart(key, uploadID string, partNumber int, body io.ReadSeeker) (string, error)
+
+	// CopyPart stores size bytes of the object srcKey, starting at offset, as a part of an upload and returns its ETag
+	CopyPart(key, uploadID string, partNumber int, srcKey string, offset, size int64) (string, error)
+
+	// Parts returns the parts uploaded so far, in number order
+	Parts(key, uploadID string) ([]Part, error)
+
+	// CompleteUpload creates (or replaces) the object from the parts and returns its ETag, or "" if it isn't made from
+	// the MD5s of the parts.  It fails without changing the object if the parts don't have the ETags that were
+	// returned when they were uploaded.
+	CompleteUpload(key, uploadID string, parts []Part) (string, error)
+
+	// AbortUpload discards an upload and its parts
+	AbortUpload(key, uploadID string) error
+}
+
+// Upload is a multipart upload that hasn't been completed or aborted
+type Upload struct {
+	Key, ID   string
+	Initiated time.Time
+}
+
+// Part is a part of a multipart upload
+type Part struct {
+	Number int
+	Size   int64
+	ETag   string // without quotes, the MD5 of the part unless the store encrypts it with a key of its own
+}
+
+// MetadataStore is implemented by stores that can keep metadata with an object (eg: its checksums)
+type MetadataStore interface {
+	// PutWithMetadata is Put with metadata stored with the object, so it has it from when it's created.  Keys should
+	// be lower case.
+	PutWithMetadata(key string, body io.Reader, metadata map[string]string) error
+}
+
+// ObjectInfo is the metadata for an object.  ETag and Metadata are only set by Head and Get, and only by stores that
+// have them.
+type ObjectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	ETag         string            // without quotes, the MD5 of the object unless it was a multipart upload
+	Metadata     map[string]string // user metadata, S3 may change the case of the keys
+}
+
+// ObjectList is a page of results from ObjectStore.List
+type ObjectList struct {
+	Objects               []ObjectInfo
+	CommonPrefixes        []string
+	NextContinuationToken string // empty on the last page
+}
+
+// DeleteError is an object that couldn't be deleted
+type DeleteError struct {
+	Key, Code, Message string
+}
+
+// DeleteErrors is returned by ObjectStore.Delete when some of the objects couldn't be deleted
+type DeleteErrors []DeleteError
+
+func (e DeleteErrors) Error() string {
+	// keep the message short (and on one line) for FTP clients, the first few keys are enough to go on
+	const maxKeys = 3
+
+	var keys []string
+	for i, d := range e {
+		if i == maxKeys {
+			keys = append(keys, fmt.Sprintf("and %d more", len(e)-maxKeys))
+			break
+		}
+		keys = append(keys, fmt.Sprintf("%s (%s: %s)", d.Key, d.Code, d.Message))
+	}
+
+	return fmt.Sprintf("Failed to delete %d objects: %s", len(e), strings.Join(keys, ", "))
+}
+
+// errNoSuchUpload is returned by the backends other than S3 for an upload id that doesn't exist
+var errNoSuchUpload = errors.New("NoSuchUpload: The specified upload does not exist")
+
+// errInvalidPart is returned by the backends other than S3 for completing an upload with a part that doesn't exist or
+// has a different ETag
+var errInvalidPart = errors.New("InvalidPart: One or more of the specified parts could not be found")
+
+// errInvalidOffset is returned by Get for an offset past the end of the object
+var errInvalidOffset = errors.New("Offset is past the end of the file")
+
+// errNoSuchKey is returned by the backends other than S3 when an object doesn't exist
+type errNoSuchKey struct {
+	key string
+}
+
+func (e errNoSuchKey) Error() string {
+	return "NoSuchKey: The specified key does not exist: " + e.key
+}
+
+// isNoSuchKey returns true if err is from looking up an object that doesn't exist, as opposed to a failed request
+func isNoSuchKey(err error) bool {
+	if _, ok := err.(errNoSuchKey); ok {
+		return true
+	}
+
+	// HeadObject doesn't have a response body so S3 errors for it only have the status
+	if awsErr, ok := err.(awserr.Error); ok {
+		return awsErr.Code() == "NoSuchKey" || awsErr.Code() == "NotFound"
+	}
+
+	return false
+}
+
+// multipartETag returns the ETag S3 gives an object made from parts, given the MD5s of the parts one after another.
+// It's the MD5 of the parts' MD5s and the number of parts, eg: "9b2cf535f27731c974343645a3985328-2".
+func multipartETag(partSums []byte) string {
+	sum := md5.Sum(partSums)
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(partSums)/md5.Size)
+}
+
+// objectsByKey sorts objects in S3 (byte-wise) key order
+type objectsByKey []ObjectInfo
+
+func (o objectsByKey) Len() int           { return len(o) }
+func (o objectsByKey) Less(i, j int) bool { return o[i].Key < o[j].Key }
+func (o objectsByKey) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+
+// partsByNumber sorts parts into number order
+type partsByNumber []Part
+
+func (p partsByNumber) Len() int           { return len(p) }
+func (p partsByNumber) Less(i, j int) bool { return p[i].Number < p[j].Number }
+func (p partsByNumber) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// listPage implements ObjectStore.List for backends that can produce all the candidate objects up front.  objects
+// must be sorted by key and may include keys that don't match prefix.  Keys are rolled up into CommonPrefixes the way
+// S3 does it and at most pageSize keys and prefixes are returned, with the last one used as the continuation token.
+func listPage(objects []ObjectInfo, prefix, delimiter, continuationToken string, pageSize int) *ObjectList {
+	list := &ObjectList{}
+	count := 0
+	lastPrefix := ""
+
+	for _, o := range objects {
+		if !strings.HasPrefix(o.Key, prefix) || (continuationToken != "" && o.Key <= continuationToken) {
+			continue
+		}
+
+		if delimiter != "" {
+			if i := strings.Index(o.Key[len(prefix):], delimiter); i >= 0 {
+				commonPrefix := o.Key[:len(prefix)+i+len(delimiter)]
+
+				// objects are sorted so the keys sharing a prefix are all together.  The continuation token can be a
+				// common prefix from the previous page.
+				if commonPrefix == lastPrefix || commonPrefix == continuationToken {
+					continue
+				}
+
+				if count == pageSize {
+					list.NextContinuationToken = lastKey(list)
+					break
+				}
+
+				list.CommonPrefixes = append(list.CommonPrefixes, commonPrefix)
+				lastPrefix = commonPrefix
+				count++
+				continue
+			}
+		}
+
+		if count == pageSize {
+			list.NextContinuationToken = lastKey(list)
+			break
+		}
+
+		list.Objects = append(list.Objects, o)
+		count++
+	}
+
+	return list
+}
+
+// lastKey returns the greatest key or common prefix in a page of results
+func lastKey(list *ObjectList) string {
+	var key string
+
+	if len(list.Objects) > 0 {
+		key = list.Objects[len(list.Objects)-1].Key
+	}
+
+	if len(list.CommonPrefixes) > 0 && list.CommonPrefixes[len(list.CommonPrefixes)-1] > key {
+		key = list.CommonPrefixes[len(list.CommonPrefixes)-1]
+	}
+
+	return key
+}
@@ -0,0 +1,133 @@
+package main
+
+// Password hashing for the users file.  Hashes are stored in their usual string encodings:
+//   bcrypt:   $2a$10$...
+//   argon2id: $argon2id$v=19$m=65536,t=1,p=4$<base64 salt>$<base64 key>
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"strings"
+)
+
+const (
+	hashBcrypt   = "bcrypt"
+	hashArgon2id = "argon2id"
+
+	// argon2id parameters used for new hashes (the recommended settings from the argon2 package docs)
+	argon2Time    = 1
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+// hashPassword returns an encoded hash of the password using the named algorithm
+func hashPassword(algorithm, password string) (string, error) {
+	switch algorithm {
+	case hashBcrypt:
+		h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return string(h), nil
+	case hashArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+	}
+
+	return "", fmt.Errorf("unknown password hash algorithm: %s", algorithm)
+}
+
+// checkPasswordHash returns true if the password matches the encoded hash.  Comparisons are constant time.
+func checkPasswordHash(hash, password string) bool {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		a, err := parseArgon2Hash(hash)
+		if err != nil {
+			return false
+		}
+
+		key := argon2.IDKey([]byte(password), a.salt, a.time, a.memory, a.threads, uint32(len(a.key)))
+		return subtle.ConstantTimeCompare(key, a.key) == 1
+	}
+
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// checkPlainPassword compares two plain text passwords in constant time.  The passwords are hashed first so the time
+// taken doesn't depend on their lengths.
+func checkPlainPassword(expected, password string) bool {
+	e := sha256.Sum256([]byte(expected))
+	p := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(e[:], p[:]) == 1
+}
+
+// validatePasswordHash checks that an encoded hash from the users file can be used
+func validatePasswordHash(hash string) error {
+	if strings.HasPrefix(hash, "$argon2id$") {
+		_, err := parseArgon2Hash(hash)
+		return err
+	}
+
+	if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+		return fmt.Errorf("invalid bcrypt or argon2id password hash: %s", err)
+	}
+
+	return nil
+}
+
+type argon2Hash struct {
+	time, memory uint32
+	threads      uint8
+	salt, key    []byte
+}
+
+func parseArgon2Hash(hash string) (*argon2Hash, error) {
+	// "", "argon2id", "v=19", "m=65536,t=1,p=4", salt, key
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != hashArgon2id {
+		return nil, errors.New("invalid argon2id password hash")
+	}
+
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil {
+		return nil, fmt.Errorf("invalid argon2id password hash version: %s", err)
+	}
+
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version: %d", version)
+	}
+
+	a := &argon2Hash{}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &a.memory, &a.time, &a.threads); err != nil {
+		return nil, fmt.Errorf("invalid argon2id password hash parameters: %s", err)
+	}
+
+	var err error
+	if a.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id password hash salt: %s", err)
+	}
+
+	if a.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil {
+		return nil, fmt.Errorf("invalid argon2id password hash key: %s", err)
+	}
+
+	if len(a.key) == 0 || a.time == 0 || a.threads == 0 {
+		return nil, errors.New("invalid argon2id password hash parameters")
+	}
+
+	return a, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestPasswordHash(t *testing.T) {
+	for _, algorithm := range []string{hashBcrypt, hashArgon2id} {
+		t.Run(algorithm, func(t *testing.T) {
+			var err error
+			var hash string
+			if hash, err = hashPassword(algorithm, "secret"); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = validatePasswordHash(hash); err != nil {
+				t.Error(err)
+			}
+
+			if !checkPasswordHash(hash, "secret") {
+				t.Errorf("expected password to match hash: %s", hash)
+			}
+
+			if checkPasswordHash(hash, "Secret") {
+				t.Errorf("expected wrong password not to match hash: %s", hash)
+			}
+
+			u := &User{Name: "wgtn", PasswordHash: hash}
+			if !u.checkPassword("secret") || u.checkPassword("") {
+				t.Error("unexpected result checking user password")
+			}
+		})
+	}
+
+	if _, err := hashPassword("md5", "secret"); err == nil {
+		t.Error("expected an error for an unknown algorithm")
+	}
+}
+
+func TestInvalidPasswordHash(t *testing.T) {
+	testCases := []string{
+		"secret",
+		"$2a$10$tooshort",
+		"$argon2id$v=19$m=65536,t=1,p=4$c2FsdA",
+		"$argon2id$v=18$m=65536,t=1,p=4$c2FsdHNhbHQ$a2V5a2V5",
+		"$argon2id$v=19$m=65536,t=0,p=4$c2FsdHNhbHQ$a2V5a2V5",
+		"$argon2id$v=19$m=65536,t=1,p=4$!!!$a2V5a2V5",
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc, func(t *testing.T) {
+			if err := validatePasswordHash(tc); err == nil {
+				t.Errorf("expected invalid hash: %s", tc)
+			}
+
+			if checkPasswordHash(tc, "secret") {
+				t.Errorf("expected invalid hash not to match: %s", tc)
+			}
+		})
+	}
+}
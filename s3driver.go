@@ -3,27 +3,49 @@ package main
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
-	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/fclairamb/ftpserver/server"
+	"hash/fnv"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 )
 
+var errPermissionDenied = errors.New("Permission denied")
+
+const (
+	// dirLookupConcurrency limits the concurrent requests for directory timestamps when listing with dirModTimes
+	dirLookupConcurrency = 16
+	// renameConcurrency limits the concurrent copies when renaming a directory
+	renameConcurrency = 16
+	// how often (in objects copied) to log the progress of a rename
+	renameProgressInterval = 1000
+)
+
 type S3Driver struct {
-	s3Session    *session.Session
-	s3Client     *s3.S3
-	s3BucketName string
-	rootPrefix   string
-	ftpPort      int
-	ftpUser      string
-	ftpPasswd    string
+	store      ObjectStore
+	rootPrefix string
+	ftpPort    int
+	users      *UserStore
+	user       *User       // the authenticated user, only set on the per-session copy returned by AuthUser
+	tlsConfig  *tls.Config // nil if FTPS isn't configured
+	// look up the directory marker for each directory in a listing to get its timestamp.  Otherwise directories are
+	// listed straight from the common prefixes without any extra requests.
+	dirModTimes bool
+	// treat any prefix with keys below it as a directory, even without a marker object (eg: data written to the
+	// bucket by other tools).  Otherwise directories need a marker for files to be written in them, etc.
+	implicitDirs bool
+	// keep interrupted uploads so they can be resumed with REST and STOR.  nil if uploads aren't resumable.
+	uploads MultipartStore
+	// the checksums to store with uploads (eg: "md5"), if the storage backend supports metadata
+	checksums []string
 }
 
 func (d *S3Driver) WelcomeUser(cc server.ClientContext) (string, error) {
@@ -33,27 +55,46 @@ func (d *S3Driver) WelcomeUser(cc server.ClientContext) (string, error) {
 
 func (d *S3Driver) AuthUser(cc server.ClientContext, user, pass string) (server.ClientHandlingDriver, error) {
 
-	if user != d.ftpUser {
-		log.Println("username does not match expected user", user)
-		return nil, fmt.Errorf("incorrect username: %s", user)
+	// refused before the password is checked, so the reply is the same whether or not the password is right
+	if (cc == nil || !cc.HasTLSForControl()) && d.users.RequiresTLS(user) {
+		log.Println("user requires TLS but the control connection is not encrypted", user)
+		return nil, errors.New("TLS is required for this user, use AUTH TLS before logging in")
 	}
 
-	if pass != d.ftpPasswd {
-		log.Println("incorrect password")
-		return nil, errors.New("incorrect password")
-	}
-
-	_, err := session.NewSession()
+	u, err := d.users.Authenticate(user, pass, verifiedClientCert(cc))
 	if err != nil {
-		log.Println("error creating S3 session (check AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY env vars on server):", err)
 		return nil, err
 	}
 
-	return d, nil
+	// each session gets its own copy of the driver with the root prefix narrowed to the user's home prefix
+	userDriver := *d
+	userDriver.user = u
+	userDriver.rootPrefix = d.rootPrefix + u.Home
+
+	return &userDriver, nil
+}
+
+// verifiedClientCert returns the TLS client certificate presented on the control connection if it was verified
+// against the client CAs, otherwise nil
+func verifiedClientCert(cc server.ClientContext) *x509.Certificate {
+	if cc == nil {
+		return nil
+	}
+
+	state := cc.TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return state.VerifiedChains[0][0]
 }
 
 func (d *S3Driver) GetTLSConfig() (*tls.Config, error) {
-	return nil, errors.New("TLS not implemented")
+	if d.tlsConfig == nil {
+		return nil, errors.New("TLS is not configured on this server")
+	}
+
+	return d.tlsConfig, nil
 }
 
 func (d *S3Driver) ChangeDirectory(cc server.ClientContext, directory string) error {
@@ -71,24 +112,17 @@ func (d *S3Driver) ChangeDirectory(cc server.ClientContext, directory string) er
 		return err
 	}
 
-	delimiter := "/"
-	params := &s3.ListObjectsV2Input{
-		Bucket:    &S3_BUCKET_NAME,
-		Prefix:    &prefix,
-		Delimiter: &delimiter, // limits the search to directories (they have a trailing slash)
-	}
-
-	var resp *s3.ListObjectsV2Output
-	if resp, err = d.s3Client.ListObjectsV2(params); err != nil {
-		return stripNewlines(err)
-	}
-
 	// prefix of "" is a special case, the root directory of a bucket which can have zero objects
 	if prefix == "" {
 		return nil
 	}
 
-	if *resp.KeyCount == 0 {
+	var exists bool
+	if exists, err = d.prefixExists(prefix); err != nil {
+		return err
+	}
+
+	if !exists {
 		return errors.New("No such directory: " + directory)
 	}
 
@@ -97,6 +131,10 @@ func (d *S3Driver) ChangeDirectory(cc server.ClientContext, directory string) er
 
 func (d *S3Driver) MakeDirectory(cc server.ClientContext, directory string) error {
 
+	if d.perms().noMkdir {
+		return errPermissionDenied
+	}
+
 	var err error
 	var s3Key string
 	if s3Key, err = d.getS3Key(directory + "/"); err != nil {
@@ -121,35 +159,15 @@ func (d *S3Driver) MakeDirectory(cc server.ClientContext, directory string) erro
 		return fmt.Errorf("Directory '%s' has non-existent parent directory: %s", directory, parentKey)
 	}
 
-	params := &s3.PutObjectInput{
-		Bucket: &S3_BUCKET_NAME,
-		Key:    &s3Key,
-		Body:   bytes.NewReader([]byte("")),
-	}
-
-	if _, err = d.s3Client.PutObject(params); err != nil {
-		return stripNewlines(err)
-	}
-
-	return nil
-}
-
-// AWS errors may include newlines that interfere with FTP commands so strip them out
-func stripNewlines(err error) error {
-	if err != nil {
-		if awsErr, ok := err.(awserr.Error); ok {
-			strippedMessage := strings.Replace(awsErr.Message(), "\n", "", -1)
-			return awserr.New(awsErr.Code(), strippedMessage, awsErr.OrigErr())
-		} else {
-			return err
-		}
-	}
-
-	return nil
+	return d.store.Put(s3Key, bytes.NewReader([]byte("")))
 }
 
 func (d *S3Driver) ListFiles(cc server.ClientContext) ([]os.FileInfo, error) {
 
+	if d.perms().noList {
+		return nil, errPermissionDenied
+	}
+
 	var err error
 	var prefix string
 	if prefix, err = d.getS3Key(cc.Path()); err != nil {
@@ -161,58 +179,87 @@ func (d *S3Driver) ListFiles(cc server.ClientContext) ([]os.FileInfo, error) {
 		prefix += "/"
 	}
 
-	delimiter := "/" // delimiter keeps the listing from being recursive
-	params := &s3.ListObjectsV2Input{
-		Bucket:    &S3_BUCKET_NAME,
-		Prefix:    &prefix,
-		Delimiter: &delimiter,
-	}
-
 	files := []os.FileInfo{}
+	var dirKeys []string
+	var token string
 
 	for {
-		var resp *s3.ListObjectsV2Output
-		if resp, err = d.s3Client.ListObjectsV2(params); err != nil {
-			return nil, stripNewlines(err)
+		// delimiter keeps the listing from being recursive
+		var list *ObjectList
+		if list, err = d.store.List(prefix, "/", token); err != nil {
+			return nil, err
 		}
 
 		// directories other than CWD
-		for _, dir := range resp.CommonPrefixes {
-			relKey := strings.Replace(*dir.Prefix, d.rootPrefix, "", 1)
-
-			var dirInfo os.FileInfo
-			if dirInfo, err = d.GetFileInfo(cc, relKey); err != nil {
-				return nil, err
-			}
-
-			files = append(files, dirInfo)
-		}
+		dirKeys = append(dirKeys, list.CommonPrefixes...)
 
 		// files and CWD
-		for _, f := range resp.Contents {
+		for _, f := range list.Objects {
 
 			// don't list CWD in the list of files
-			if *f.Key == prefix {
+			if f.Key == prefix {
 				continue
 			}
 
-			relKey := strings.Replace(*f.Key, d.rootPrefix, "", 1)
-
 			var fi os.FileInfo
-			if fi, err = d.getFakeFileInfo(relKey, *f.Size, *f.LastModified); err != nil {
+			if fi, err = d.getFakeFileInfo(f.Key, f.Size, f.LastModified); err != nil {
 				return nil, err
 			}
 			files = append(files, fi)
 		}
 
-		if resp.IsTruncated == nil || !*resp.IsTruncated {
+		if list.NextContinuationToken == "" {
 			break
 		}
 
-		params.ContinuationToken = resp.NextContinuationToken
+		token = list.NextContinuationToken
+	}
+
+	var modTimes []time.Time
+	if d.dirModTimes {
+		modTimes = d.dirModTimesOf(dirKeys)
+	}
+
+	dirs := make([]os.FileInfo, len(dirKeys))
+	for i, dir := range dirKeys {
+		var modTime time.Time
+		if modTimes != nil {
+			modTime = modTimes[i]
+		}
+
+		// the size of a directory, just faking it.
+		if dirs[i], err = d.getFakeFileInfo(dir, 4096, modTime); err != nil {
+			return nil, err
+		}
+	}
+
+	return append(dirs, files...), nil
+}
+
+// dirModTimesOf returns the last modified times of directory markers, with dirLookupConcurrency requests at a time.
+// Directories without a marker (implied by the keys below them) get the zero time.
+func (d *S3Driver) dirModTimesOf(dirKeys []string) []time.Time {
+	modTimes := make([]time.Time, len(dirKeys))
+	sem := make(chan bool, dirLookupConcurrency)
+	var wg sync.WaitGroup
+
+	for i := range dirKeys {
+		wg.Add(1)
+		sem <- true
+
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			if info, err := d.store.Head(dirKeys[i]); err == nil {
+				modTimes[i] = info.LastModified
+			}
+		}(i)
 	}
 
-	return files, nil
+	wg.Wait()
+
+	return modTimes
 }
 
 func (d *S3Driver) UserLeft(cc server.ClientContext) {
@@ -225,10 +272,21 @@ func (d *S3Driver) OpenFile(cc server.ClientContext, path string, flag int) (ser
 	var s3key string
 	var parentExists bool
 
+	perms := d.perms()
+	if (flag == os.O_RDONLY && perms.noRead) || (flag != os.O_RDONLY && perms.noWrite) {
+		return nil, errPermissionDenied
+	}
+
 	if s3key, err = d.getS3Key(path); err != nil {
 		return nil, err
 	}
 
+	if flag != os.O_RDONLY && perms.noOverwrite {
+		if _, err = d.store.Head(s3key); err == nil {
+			return nil, fmt.Errorf("%s: file already exists", errPermissionDenied)
+		}
+	}
+
 	if parentExists, err = d.parentExists(s3key); err != nil {
 		return nil, err
 	}
@@ -237,75 +295,116 @@ func (d *S3Driver) OpenFile(cc server.ClientContext, path string, flag int) (ser
 		return nil, fmt.Errorf("Path has non-existent parent directory: %s", path)
 	}
 
-	if s3file, err = NewS3VirtualFile(s3key, flag, d.s3Session, d.s3Client); err != nil {
+	if s3file, err = NewS3VirtualFile(s3key, flag, d.store, d.uploads, d.checksums); err != nil {
 		return nil, err
 	}
 
 	return s3file, nil
 }
 
-func (d *S3Driver) getObjectInfo(key string) (*s3.GetObjectOutput, error) {
-	params := &s3.GetObjectInput{
-		Bucket: &S3_BUCKET_NAME,
-		Key:    &key,
-	}
-
-	req, resp := d.s3Client.GetObjectRequest(params)
+func (d *S3Driver) GetFileInfo(cc server.ClientContext, path string) (os.FileInfo, error) {
 
-	if err := req.Send(); err != nil {
-		return nil, stripNewlines(err)
+	if d.perms().noList {
+		return nil, errPermissionDenied
 	}
 
-	return resp, nil
-}
-
-func (d *S3Driver) GetFileInfo(cc server.ClientContext, path string) (os.FileInfo, error) {
-
 	var err error
 	relPath := path
 	if relPath, err = d.getS3Key(path); err != nil {
 		return nil, err
 	}
 
-	var resp *s3.GetObjectOutput
+	// the root (or home) directory always exists, even without a marker, like in ChangeDirectory
+	if dir := strings.TrimSuffix(relPath, "/"); dir == strings.TrimSuffix(d.rootPrefix, "/") {
+		return d.getFakeFileInfo(dir+"/", 4096, time.Time{})
+	}
+
+	var info *ObjectInfo
 	// check for directories (trailing slashes) if we can't find the file
-	if resp, err = d.getObjectInfo(relPath); err != nil {
+	if info, err = d.store.Head(relPath); err != nil {
+		fileErr := err
 
-		if resp, err = d.getObjectInfo(relPath + "/"); err != nil {
-			return nil, err
-		} else {
-			relPath += "/"
+		if info, err = d.store.Head(relPath + "/"); err != nil && d.implicitDirs {
+			// a directory without a marker doesn't have a timestamp
+			if exists, listErr := d.prefixExists(relPath + "/"); listErr == nil && exists {
+				info, err = &ObjectInfo{Key: relPath + "/"}, nil
+			}
 		}
-	}
 
-	// resp itself, resp.ContentLength and resp.LastModified are sometimes nil (!) so check for this state.  Aws!
-	if resp == nil {
-		return nil, fmt.Errorf("Error getting file info for key: %s", relPath)
-	}
-
-	var objectSize int64
-	if resp.ContentLength != nil {
-		objectSize = *resp.ContentLength
+		if err != nil {
+			// a new file with an interrupted upload has the size received so far, which is where the client should
+			// resume from.  Uploads aren't cached so they're only looked up for paths that aren't files or directories.
+			if d.uploads != nil && isNoSuchKey(fileErr) {
+				upload, parts, uploadErr := pendingUpload(d.uploads, relPath)
+				if uploadErr != nil {
+					return nil, uploadErr
+				}
+
+				if upload != nil {
+					return d.getFakeFileInfo(relPath, partsSize(parts), upload.Initiated)
+				}
+			}
 
-		if strings.HasSuffix(relPath, "/") {
-			// the size of a directory, just faking it.
-			objectSize = 4096
+			return nil, err
 		}
+
+		relPath += "/"
 	}
 
-	var modTime time.Time
-	if resp.LastModified != nil {
-		modTime = *resp.LastModified
+	objectSize := info.Size
+	if strings.HasSuffix(relPath, "/") {
+		// the size of a directory, just faking it.
+		objectSize = 4096
 	}
 
 	var f os.FileInfo
-	if f, err = d.getFakeFileInfo(relPath, objectSize, modTime); err != nil {
+	if f, err = d.getFakeFileInfo(relPath, objectSize, info.LastModified); err != nil {
 		return nil, err
 	}
 
 	return f, nil
 }
 
+// GetFileHash returns the checksum stored with the object if it has one for the algorithm, otherwise the object is
+// read to calculate it
+func (d *S3Driver) GetFileHash(cc server.ClientContext, path string, algorithm server.HashAlgorithm) (string, error) {
+
+	if d.perms().noRead {
+		return "", errPermissionDenied
+	}
+
+	h, checksum, err := newFileHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	var s3Key string
+	if s3Key, err = d.getS3Key(path); err != nil {
+		return "", err
+	}
+
+	var info *ObjectInfo
+	if info, err = d.store.Head(s3Key); err != nil {
+		return "", err
+	}
+
+	if v, ok := expectedChecksums(info)[checksum]; ok {
+		return v, nil
+	}
+
+	body, _, err := d.store.Get(s3Key, 0)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	if _, err = io.Copy(h, body); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
 func (d *S3Driver) CanAllocate(cc server.ClientContext, size int) (bool, error) {
 	return true, nil
 }
@@ -318,6 +417,10 @@ func (d *S3Driver) DeleteFile(cc server.ClientContext, path string) error {
 	// list objects matching the path, then use DeleteObjects on all of them.  Needed because you must delete all
 	// child key/objects belonging to a directory key before deleting that key
 
+	if d.perms().noDelete {
+		return errPermissionDenied
+	}
+
 	var err error
 	var relPath string
 	if relPath, err = d.getS3Key(path); err != nil {
@@ -333,45 +436,27 @@ func (d *S3Driver) DeleteFile(cc server.ClientContext, path string) error {
 		relPath += "/"
 	}
 
-	listParams := &s3.ListObjectsV2Input{
-		Bucket: &S3_BUCKET_NAME,
-		Prefix: &relPath,
-		//Delimiter: &delimiter, // empty delim makes this recursive
+	if relPath == "" || relPath == d.rootPrefix {
+		return errors.New("Cannot delete the root directory")
 	}
 
-	var delObjects []*s3.ObjectIdentifier
-	for {
-		var resp *s3.ListObjectsV2Output
-		if resp, err = d.s3Client.ListObjectsV2(listParams); err != nil {
-			return stripNewlines(err)
-		}
-
-		for _, f := range resp.Contents {
-			delObjects = append(delObjects, &s3.ObjectIdentifier{Key: f.Key})
-		}
-
-		// AWS using pointers to bools (?!) so need to check for nil
-		if resp.IsTruncated == nil || !*resp.IsTruncated {
-			break
+	// a file is just its own key, listing it as a prefix would also match other files starting with the same name
+	delKeys := []string{relPath}
+	if isDir {
+		var objects []ObjectInfo
+		if objects, err = d.listObjects(relPath); err != nil {
+			return err
 		}
 
-		listParams.ContinuationToken = resp.NextContinuationToken
+		delKeys = keysOf(objects)
 	}
 
-	if len(delObjects) == 0 {
+	if len(delKeys) == 0 {
 		return fmt.Errorf("No such file or directory: %s [S3 key: %s]", path, relPath)
 	}
 
-	delParams := &s3.DeleteObjectsInput{
-		Bucket: &S3_BUCKET_NAME,
-		Delete: &s3.Delete{Objects: delObjects},
-	}
-
-	if _, err = d.s3Client.DeleteObjects(delParams); err != nil {
-		return stripNewlines(err)
-	}
-
-	return nil
+	// the store deletes in batches if there are too many keys for one request
+	return d.store.Delete(delKeys)
 }
 
 // returns true or false depending on if the path exists as a file (no trailing slash) or a directory (trailing slash)
@@ -382,17 +467,33 @@ func (d *S3Driver) isS3Dir(s3Key string) (bool, error) {
 	// clean strips any trailing slashes off
 	s3Key = filepath.Clean(s3Key)
 
+	// root dir is special case, always exists in a bucket ("" and "./" clean to ".")
+	if s3Key == "." || s3Key == "/" {
+		return true, nil
+	}
+
 	// see if the key exists as a directory and fallback to checking if it's a file
-	_, err = d.getObjectInfo(s3Key + "/")
+	_, err = d.store.Head(s3Key + "/")
 	if err == nil {
 		return true, nil
 	}
 
-	_, err = d.getObjectInfo(s3Key)
+	_, err = d.store.Head(s3Key)
 	if err == nil {
 		return false, nil
 	}
 
+	if d.implicitDirs {
+		var exists bool
+		if exists, err = d.prefixExists(s3Key + "/"); err != nil {
+			return false, err
+		}
+
+		if exists {
+			return true, nil
+		}
+	}
+
 	return false, fmt.Errorf("No such file or directory: %s", s3Key)
 }
 
@@ -400,6 +501,10 @@ func (d *S3Driver) RenameFile(cc server.ClientContext, from, to string) error {
 	// S3 doesn't have rename (or move).  We're copying all objects that match the input file or directory key
 	// to the new key name
 
+	if d.perms().noRename {
+		return errPermissionDenied
+	}
+
 	var err error
 	var relFrom, relTo string
 
@@ -443,65 +548,186 @@ func (d *S3Driver) RenameFile(cc server.ClientContext, from, to string) error {
 		return err
 	}
 
-	if _, err = d.getObjectInfo(parentDir + "/"); err != nil && len(parentDir) > 0 {
-		return fmt.Errorf("Parent directory of destination does not exist: %s. err: %s", parentDir, err)
-	}
+	if len(parentDir) > 0 {
+		var parentIsDir bool
+		if parentIsDir, err = d.isS3Dir(parentDir); err != nil {
+			return fmt.Errorf("Parent directory of destination does not exist: %s. err: %s", parentDir, err)
+		}
 
-	listParams := &s3.ListObjectsV2Input{
-		Bucket: &S3_BUCKET_NAME,
-		Prefix: &relFrom,
+		if !parentIsDir {
+			return fmt.Errorf("Parent directory of destination is a file: %s", parentDir)
+		}
 	}
 
-	var srcObjects []*s3.ObjectIdentifier
-	for {
-		var resp *s3.ListObjectsV2Output
-		if resp, err = d.s3Client.ListObjectsV2(listParams); err != nil {
-			return stripNewlines(err)
+	var srcObjects []ObjectInfo
+	var existing map[string]bool
+
+	if !isDir {
+		// a file is just its own key, listing it as a prefix would also match other files starting with the same name
+		var info *ObjectInfo
+		if info, err = d.store.Head(relFrom); err != nil {
+			return err
 		}
 
-		for _, f := range resp.Contents {
-			srcObjects = append(srcObjects, &s3.ObjectIdentifier{Key: f.Key})
+		srcObjects = []ObjectInfo{*info}
+	} else {
+		if strings.HasPrefix(relTo, relFrom) {
+			return errors.New("Cannot move a directory inside itself")
 		}
 
-		// AWS using pointers to bools (?!) so need to check for nil
-		if resp.IsTruncated == nil || !*resp.IsTruncated {
-			break
+		if srcObjects, err = d.listObjects(relFrom); err != nil {
+			return err
+		}
+
+		// the directory is merged into an existing destination.  Keys that were already there are kept if the
+		// rename fails.
+		var dstObjects []ObjectInfo
+		if dstObjects, err = d.listObjects(relTo); err != nil {
+			return err
 		}
 
-		listParams.ContinuationToken = resp.NextContinuationToken
+		existing = make(map[string]bool)
+		for _, o := range dstObjects {
+			existing[o.Key] = true
+		}
 	}
 
 	if len(srcObjects) == 0 {
 		return fmt.Errorf("Zero files matching pattern:%s", from)
 	}
 
-	// copy all destinations objects from source to dest (already ordered from top level directory key)
-	for _, objId := range srcObjects {
+	if err = d.copyObjects(srcObjects, relFrom, relTo, existing); err != nil {
+		return err
+	}
+
+	// delete original file (or nested directory of matching keys).  Faster than looping over them.
+	if err = d.store.Delete(keysOf(srcObjects)); err != nil {
+		return fmt.Errorf("Copied %s to %s but couldn't delete the original: %s", from, to, err)
+	}
+
+	return nil
+}
+
+// copyObjects copies objects with keys starting with fromPrefix to the same keys starting with toPrefix, with
+// renameConcurrency copies at a time.  If a copy fails no more are started and the objects that were copied are deleted
+// so a failed rename doesn't leave a partial copy behind.  Keys in existing were there before the rename and are never
+// deleted (a copy over one of them can't be undone).
+func (d *S3Driver) copyObjects(objects []ObjectInfo, fromPrefix, toPrefix string, existing map[string]bool) error {
+	start := time.Now()
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var copied []string
+	var done int
+	var copyErr error
+
+	jobs := make(chan ObjectInfo)
+
+	for i := 0; i < renameConcurrency; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for o := range jobs {
+				toKey := toPrefix + strings.TrimPrefix(o.Key, fromPrefix)
+				err := d.store.Copy(o.Key, toKey, o.Size)
+
+				mu.Lock()
+				if err != nil {
+					if copyErr == nil {
+						copyErr = fmt.Errorf("Error copying %s to %s: %s", o.Key, toKey, err)
+					}
+				} else {
+					done++
+					if !existing[toKey] {
+						copied = append(copied, toKey)
+					}
+
+					if done%renameProgressInterval == 0 {
+						log.Printf("renaming %s to %s: copied %d of %d objects", fromPrefix, toPrefix, done, len(objects))
+					}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, o := range objects {
+		mu.Lock()
+		failed := copyErr != nil
+		mu.Unlock()
 
-		toPath := strings.Replace(*objId.Key, relFrom, relTo, 1)
-		copySrc := S3_BUCKET_NAME + "/" + *objId.Key
-		copyParams := &s3.CopyObjectInput{
-			Bucket:     &S3_BUCKET_NAME,
-			Key:        &toPath,
-			CopySource: &copySrc,
+		if failed {
+			break
 		}
 
-		if _, err = d.s3Client.CopyObject(copyParams); err != nil {
-			return stripNewlines(err)
+		jobs <- o
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	if copyErr == nil {
+		if len(objects) >= renameProgressInterval {
+			log.Printf("renaming %s to %s: copied %d objects in %s", fromPrefix, toPrefix, len(objects), time.Since(start))
 		}
+
+		return nil
 	}
 
-	// delete original file (or nested directory of matching keys).  Faster than looping over them.
-	delParams := &s3.DeleteObjectsInput{
-		Bucket: &S3_BUCKET_NAME,
-		Delete: &s3.Delete{Objects: srcObjects},
+	log.Printf("renaming %s to %s failed after copying %d of %d objects, removing the copies: %s", fromPrefix, toPrefix,
+		done, len(objects), copyErr)
+
+	if err := d.store.Delete(copied); err != nil {
+		log.Printf("error removing the copies from a failed rename of %s to %s: %s", fromPrefix, toPrefix, err)
+		return fmt.Errorf("%s (and %d partial copies couldn't be removed: %s)", copyErr, len(copied), err)
 	}
 
-	if _, err = d.s3Client.DeleteObjects(delParams); err != nil {
-		return stripNewlines(err)
+	return copyErr
+}
+
+// prefixExists returns true if there are any keys starting with prefix
+func (d *S3Driver) prefixExists(prefix string) (bool, error) {
+	// the delimiter limits the search to the first level below prefix
+	list, err := d.store.List(prefix, "/", "")
+	if err != nil {
+		return false, err
 	}
 
-	return nil
+	return len(list.Objects) > 0 || len(list.CommonPrefixes) > 0, nil
+}
+
+// listObjects returns all objects with keys starting with prefix.  The listing is recursive (no delimiter).
+func (d *S3Driver) listObjects(prefix string) ([]ObjectInfo, error) {
+	var objects []ObjectInfo
+	var token string
+
+	for {
+		list, err := d.store.List(prefix, "", token)
+		if err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, list.Objects...)
+
+		if list.NextContinuationToken == "" {
+			break
+		}
+
+		token = list.NextContinuationToken
+	}
+
+	return objects, nil
+}
+
+func keysOf(objects []ObjectInfo) []string {
+	keys := make([]string, len(objects))
+	for i, o := range objects {
+		keys[i] = o.Key
+	}
+
+	return keys
 }
 
 func (d *S3Driver) GetSettings() *server.Settings {
@@ -513,7 +739,8 @@ func (d *S3Driver) GetSettings() *server.Settings {
 	return &config
 }
 
-// Return a fakeInfo struct that satisfies the os.FileInfo interface, emulating a file from an S3 object
+// Return a fakeInfo struct that satisfies the os.FileInfo interface, emulating a file from an S3 object.  name is the
+// object's key.
 func (d *S3Driver) getFakeFileInfo(name string, size int64, modTime time.Time) (os.FileInfo, error) {
 
 	isDir := strings.HasSuffix(name, "/")
@@ -523,17 +750,65 @@ func (d *S3Driver) getFakeFileInfo(name string, size int64, modTime time.Time) (
 		mode = mode | os.ModeDir
 	}
 
+	// the key identifies the object for MLSD and MLST, hashed so it doesn't have characters that aren't allowed in facts
+	h := fnv.New64a()
+	h.Write([]byte(name))
+
 	f := fakeInfo{
 		name:    filepath.Base(name),
 		size:    size,
 		mode:    mode,
 		modTime: modTime,
 		isDir:   isDir,
+		perm:    d.factPerm(isDir),
+		unique:  fmt.Sprintf("%x", h.Sum64()),
 	}
 
 	return f, nil
 }
 
+// factPerm returns the perm fact for MLSD and MLST (RFC 3659), the operations the session's user can do on a file or
+// directory
+func (d *S3Driver) factPerm(isDir bool) string {
+	perms := d.perms()
+
+	var perm string
+	allow := func(ops string, ok bool) {
+		if ok {
+			perm += ops
+		}
+	}
+
+	if isDir {
+		// create files, delete, enter, rename, list, make directories and purge (delete the contents)
+		allow("c", !perms.noWrite)
+		allow("d", !perms.noDelete)
+		allow("e", true)
+		allow("f", !perms.noRename)
+		allow("l", !perms.noList)
+		allow("m", !perms.noMkdir)
+		allow("p", !perms.noDelete)
+	} else {
+		// append, delete, rename, read and write
+		allow("a", !perms.noWrite && !perms.noOverwrite)
+		allow("d", !perms.noDelete)
+		allow("f", !perms.noRename)
+		allow("r", !perms.noRead)
+		allow("w", !perms.noWrite && !perms.noOverwrite)
+	}
+
+	return perm
+}
+
+// the permissions of the session's user.  The shared driver returned by NewS3Driver has no user and isn't restricted.
+func (d *S3Driver) perms() permissions {
+	if d.user == nil {
+		return permissions{}
+	}
+
+	return d.user.perms
+}
+
 // check that any parent directories (S3 keys) exist in path.  S3 misbehaves when a child has missing parent directories.
 func (d *S3Driver) parentExists(s3Key string) (bool, error) {
 	var err error
@@ -558,13 +833,12 @@ func (d *S3Driver) parentExists(s3Key string) (bool, error) {
 // either a file or directory key (with a trailing slash)
 func (d *S3Driver) getS3Key(path string) (string, error) {
 	var err error
-	s3Key := path
+	var s3Key string
 
-	// join paths and keep relative to root dir.
-	if strings.HasPrefix(s3Key, "/") {
-		if s3Key, err = filepath.Rel("/", path); err != nil {
-			return "", err
-		}
+	// join paths and keep relative to root dir.  Relative paths are also resolved from the root dir so that ".." can
+	// never escape the root prefix (each user is jailed to their own prefix).
+	if s3Key, err = filepath.Rel("/", "/"+path); err != nil {
+		return "", err
 	}
 
 	// "/" relative to "/" is "." but in S3 this should be ""
@@ -584,22 +858,13 @@ func (d *S3Driver) getS3Key(path string) (string, error) {
 	return s3Key, nil
 }
 
-func NewS3Driver(s3Session *session.Session, s3BucketName, rootPrefix string, ftpPort int, ftpUser, ftpPasswd string) *S3Driver {
-
-	var client *s3.S3
-
-	if s3Session != nil {
-		client = s3.New(s3Session)
-	}
+func NewS3Driver(store ObjectStore, rootPrefix string, ftpPort int, users *UserStore) *S3Driver {
 
 	driver := &S3Driver{
-		s3Client:     client,
-		s3Session:    s3Session,
-		s3BucketName: s3BucketName,
-		rootPrefix:   rootPrefix,
-		ftpPort:      ftpPort,
-		ftpUser:      ftpUser,
-		ftpPasswd:    ftpPasswd,
+		store:      store,
+		rootPrefix: rootPrefix,
+		ftpPort:    ftpPort,
+		users:      users,
 	}
 
 	return driver
@@ -1,11 +1,17 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"github.com/fclairamb/ftpserver/server"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 // testing several things that don't depend on S3 (auth, etc)
@@ -19,17 +25,21 @@ func TestAuthUser(t *testing.T) {
 		user, passwd string
 		errExpected  bool
 	}{
-		{os.Getenv("FTP_USER"), os.Getenv("FTP_PASSWD"), false},
+		{FTP_USER, FTP_PASSWD, false},
 		{"", "", true},
 		{"invalid", "", true},
 		{"invalid", "badpasswd", true},
 		{"", "badpasswd", true},
 	}
 
-	var err error
+	users, err := NewUserStore(&User{Name: FTP_USER, Password: FTP_PASSWD})
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	for _, tc := range testCases {
 		t.Run(fmt.Sprintf("%s, %s, %t", tc.user, tc.passwd, tc.errExpected), func(t *testing.T) {
-			d := &S3Driver{ftpUser: os.Getenv("FTP_USER"), ftpPasswd: os.Getenv("FTP_PASSWD")}
+			d := &S3Driver{users: users}
 			if _, err = d.AuthUser(nil, tc.user, tc.passwd); (err != nil) != tc.errExpected {
 				t.Errorf("Expected username/passwd to fail: %s: %s", tc.user, tc.passwd)
 			}
@@ -50,6 +60,9 @@ func TestGetS3Key(t *testing.T) {
 		{"", "/path//", "path/"},
 		{"", "/path with spaces/", "path with spaces/"},
 		{"", "/nested/path/", "nested/path/"},
+		{"", "path", "path"},
+		{"", "../path", "path"},
+		{"", "/../../path", "path"},
 		// The same tests with a rootPrefix:
 		{"testprefix/", "", "testprefix/"},
 		{"testprefix/", "/", "testprefix/"},
@@ -59,6 +72,9 @@ func TestGetS3Key(t *testing.T) {
 		{"testprefix/", "/path//", "testprefix/path/"},
 		{"testprefix/", "/path with spaces/", "testprefix/path with spaces/"},
 		{"testprefix/", "/nested/path/", "testprefix/nested/path/"},
+		{"testprefix/", "path", "testprefix/path"},
+		{"testprefix/", "../path", "testprefix/path"},
+		{"testprefix/", "/../../path", "testprefix/path"},
 	}
 
 	var err error
@@ -76,3 +92,569 @@ func TestGetS3Key(t *testing.T) {
 		})
 	}
 }
+
+func TestUserHome(t *testing.T) {
+	users, err := NewUserStore(
+		&User{Name: "wgtn", Password: "secret1", Home: "sites/WGTN"},
+		&User{Name: "akld", Password: "secret2", Home: "sites/AKLD/"},
+		&User{Name: "admin", Password: "secret3"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		user, passwd, inputPath, s3Key string
+	}{
+		{"wgtn", "secret1", "/", "rootprefix/sites/WGTN/"},
+		{"wgtn", "secret1", "/data/file.txt", "rootprefix/sites/WGTN/data/file.txt"},
+		{"wgtn", "secret1", "/../AKLD/file.txt", "rootprefix/sites/WGTN/AKLD/file.txt"},
+		{"akld", "secret2", "/data/", "rootprefix/sites/AKLD/data/"},
+		{"admin", "secret3", "/sites/WGTN/", "rootprefix/sites/WGTN/"},
+	}
+
+	d := &S3Driver{store: NewMemStore(), users: users, rootPrefix: "rootprefix/"}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s:%s", tc.user, tc.inputPath), func(t *testing.T) {
+			var err error
+			var cd server.ClientHandlingDriver
+			if cd, err = d.AuthUser(nil, tc.user, tc.passwd); err != nil {
+				t.Fatal(err)
+			}
+
+			var s3Key string
+			if s3Key, err = cd.(*S3Driver).getS3Key(tc.inputPath); err != nil {
+				t.Fatal(err)
+			}
+
+			if s3Key != tc.s3Key {
+				t.Errorf("expected s3key: '%s' but observed: '%s' from path '%s'", tc.s3Key, s3Key, tc.inputPath)
+			}
+
+			// the home directory exists without a marker
+			if info, err := cd.GetFileInfo(nil, "/"); err != nil || !info.IsDir() {
+				t.Errorf("expected the home directory: %v %v", info, err)
+			}
+		})
+	}
+
+	// the shared driver isn't modified by logging in
+	if d.rootPrefix != "rootprefix/" || d.user != nil {
+		t.Error("AuthUser modified the shared driver")
+	}
+
+	for _, home := range []string{"/sites/WGTN/", "../sites/", ".", "sites/../../"} {
+		if _, err = NewUserStore(&User{Name: "wgtn", Password: "secret1", Home: home}); err == nil {
+			t.Errorf("expected an error for home prefix: %s", home)
+		}
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	users, err := NewUserStore(
+		&User{Name: "archive", Password: "secret1", Permissions: []string{"read-only"}},
+		&User{Name: "logger", Password: "secret2", Permissions: []string{"drop-box"}},
+		&User{Name: "operator", Password: "secret3", Permissions: []string{"no-delete", "no-rename"}},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each operation is denied before any request is made to S3 (the driver doesn't have an S3 client)
+	ops := map[string]func(d *S3Driver) error{
+		"mkdir":  func(d *S3Driver) error { return d.MakeDirectory(nil, "/dir") },
+		"delete": func(d *S3Driver) error { return d.DeleteFile(nil, "/file") },
+		"rename": func(d *S3Driver) error { return d.RenameFile(nil, "/file", "/file2") },
+		"list": func(d *S3Driver) error {
+			_, err := d.ListFiles(nil)
+			return err
+		},
+		"stat": func(d *S3Driver) error {
+			_, err := d.GetFileInfo(nil, "/file")
+			return err
+		},
+		"get": func(d *S3Driver) error {
+			_, err := d.OpenFile(nil, "/file", os.O_RDONLY)
+			return err
+		},
+		"put": func(d *S3Driver) error {
+			_, err := d.OpenFile(nil, "/file", os.O_WRONLY)
+			return err
+		},
+		"hash": func(d *S3Driver) error {
+			_, err := d.GetFileHash(nil, "/file", server.HashMD5)
+			return err
+		},
+	}
+
+	testCases := []struct {
+		user, passwd string
+		denied       []string
+	}{
+		{"archive", "secret1", []string{"mkdir", "delete", "rename", "put"}},
+		{"logger", "secret2", []string{"delete", "rename", "list", "stat", "get", "hash"}},
+		{"operator", "secret3", []string{"delete", "rename"}},
+	}
+
+	d := &S3Driver{users: users}
+	for _, tc := range testCases {
+		for _, op := range tc.denied {
+			t.Run(fmt.Sprintf("%s:%s", tc.user, op), func(t *testing.T) {
+				var err error
+				var cd server.ClientHandlingDriver
+				if cd, err = d.AuthUser(nil, tc.user, tc.passwd); err != nil {
+					t.Fatal(err)
+				}
+
+				if err = ops[op](cd.(*S3Driver)); err != errPermissionDenied {
+					t.Errorf("expected %s to be denied for %s, got: %v", op, tc.user, err)
+				}
+			})
+		}
+	}
+
+	if _, err = NewUserStore(&User{Name: "wgtn", Password: "secret1", Permissions: []string{"superuser"}}); err == nil {
+		t.Error("expected an error for an unknown permission profile")
+	}
+}
+
+// testContext is a server.ClientContext for calling driver methods directly
+type testContext struct {
+	path       string
+	controlTLS bool
+	tlsState   *tls.ConnectionState
+}
+
+func (c *testContext) Path() string             { return c.path }
+func (c *testContext) SetDebug(debug bool)      {}
+func (c *testContext) Debug() bool              { return false }
+func (c *testContext) HasTLSForControl() bool   { return c.controlTLS }
+func (c *testContext) HasTLSForTransfers() bool { return c.controlTLS }
+func (c *testContext) TLSConnectionState() *tls.ConnectionState {
+	return c.tlsState
+}
+
+func TestRequireTLS(t *testing.T) {
+	users, err := NewUserStore(
+		&User{Name: "secure", Password: "secret1", RequireTLS: true},
+		&User{Name: "legacy", Password: "secret2"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		user, passwd string
+		controlTLS   bool
+		errExpected  bool
+	}{
+		{"secure", "secret1", true, false},
+		{"secure", "secret1", false, true},
+		{"secure", "wrong", false, true},
+		{"legacy", "secret2", true, false},
+		{"legacy", "secret2", false, false},
+	}
+
+	d := &S3Driver{users: users}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s, %t, %t", tc.user, tc.controlTLS, tc.errExpected), func(t *testing.T) {
+			if _, err := d.AuthUser(&testContext{controlTLS: tc.controlTLS}, tc.user, tc.passwd); (err != nil) != tc.errExpected {
+				t.Errorf("unexpected result logging in as %s: %v", tc.user, err)
+			}
+		})
+	}
+
+	// without TLS the reply doesn't say whether the password was right
+	_, errRight := d.AuthUser(&testContext{}, "secure", "secret1")
+	_, errWrong := d.AuthUser(&testContext{}, "secure", "wrong")
+	if errRight == nil || errWrong == nil || errRight.Error() != errWrong.Error() {
+		t.Errorf("expected the same error for the right and wrong passwords: %v, %v", errRight, errWrong)
+	}
+}
+
+// countingStore counts the requests made to an ObjectStore
+type countingStore struct {
+	ObjectStore
+	mu    sync.Mutex
+	heads int
+	lists int
+}
+
+func (s *countingStore) List(prefix, delimiter, continuationToken string) (*ObjectList, error) {
+	s.mu.Lock()
+	s.lists++
+	s.mu.Unlock()
+
+	return s.ObjectStore.List(prefix, delimiter, continuationToken)
+}
+
+func (s *countingStore) Head(key string) (*ObjectInfo, error) {
+	s.mu.Lock()
+	s.heads++
+	s.mu.Unlock()
+
+	return s.ObjectStore.Head(key)
+}
+
+func TestListFilesDirs(t *testing.T) {
+	mem := NewMemStore()
+	for i := 0; i < 50; i++ {
+		if err := mem.Put(fmt.Sprintf("stations/dir%02d/", i), strings.NewReader("")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a directory implied by a key below it, without a marker
+	if err := mem.Put("stations/implied/file.txt", strings.NewReader("data")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dirModTimes := range []bool{false, true} {
+		t.Run(fmt.Sprintf("dirModTimes %t", dirModTimes), func(t *testing.T) {
+			store := &countingStore{ObjectStore: mem}
+			d := &S3Driver{store: store, dirModTimes: dirModTimes}
+
+			files, err := d.ListFiles(&testContext{path: "/stations"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(files) != 51 {
+				t.Fatalf("expected 51 directories, got %d", len(files))
+			}
+
+			for _, f := range files {
+				if !f.IsDir() {
+					t.Errorf("expected %s to be a directory", f.Name())
+				}
+
+				// only directories with a marker have a timestamp
+				if hasTime := !f.ModTime().IsZero(); hasTime != (dirModTimes && f.Name() != "implied") {
+					t.Errorf("unexpected mod time for %s: %s", f.Name(), f.ModTime())
+				}
+			}
+
+			expectedHeads := 0
+			if dirModTimes {
+				expectedHeads = 51
+			}
+
+			if store.heads != expectedHeads {
+				t.Errorf("expected %d HEAD requests, got %d", expectedHeads, store.heads)
+			}
+		})
+	}
+}
+
+func TestImplicitDirs(t *testing.T) {
+	mem := NewMemStore()
+
+	// written by another tool, without directory markers
+	for _, key := range []string{"data/2017/a.txt", "data/2017/b.txt", "data/2018/c.txt"} {
+		if err := mem.Put(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cc := &testContext{path: "/"}
+
+	d := &S3Driver{store: mem}
+	if _, err := d.OpenFile(cc, "/data/2017/new.txt", os.O_WRONLY); err == nil {
+		t.Error("expected an error writing to a directory without a marker")
+	}
+
+	d.implicitDirs = true
+
+	if err := d.ChangeDirectory(cc, "/data/2017"); err != nil {
+		t.Error(err)
+	}
+
+	if err := d.ChangeDirectory(cc, "/data/2019"); err == nil {
+		t.Error("expected an error changing to a missing directory")
+	}
+
+	fi, err := d.GetFileInfo(cc, "/data")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !fi.IsDir() {
+		t.Error("expected data to be a directory")
+	}
+
+	f, err := d.OpenFile(cc, "/data/2017/new.txt", os.O_WRONLY)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// markers are still created for new directories
+	if err = d.MakeDirectory(cc, "/data/2018/sub"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = mem.Head("data/2018/sub/"); err != nil {
+		t.Error("expected a directory marker for a new directory")
+	}
+
+	if err = d.RenameFile(cc, "/data/2017", "/data/2019"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = mem.Head("data/2019/a.txt"); err != nil {
+		t.Error("expected a renamed file")
+	}
+
+	if err = d.DeleteFile(cc, "/data"); err != nil {
+		t.Fatal(err)
+	}
+
+	if list, _ := mem.List("", "", ""); len(list.Objects) != 0 {
+		t.Errorf("expected everything to be deleted, found %d objects", len(list.Objects))
+	}
+}
+
+func TestDeleteFile(t *testing.T) {
+	mem := NewMemStore()
+	for _, key := range []string{"data/", "data/a.txt", "data/a.txt.bak", "data/sub/", "data/sub/b.txt"} {
+		if err := mem.Put(key, strings.NewReader("")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cc := &testContext{path: "/"}
+	d := &S3Driver{store: mem}
+
+	// only the file, not other keys starting with its name
+	if err := d.DeleteFile(cc, "/data/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mem.Head("data/a.txt.bak"); err != nil {
+		t.Error("expected data/a.txt.bak to be kept")
+	}
+
+	if err := d.DeleteFile(cc, "/"); err == nil {
+		t.Error("expected an error deleting the root directory")
+	}
+
+	if err := d.DeleteFile(cc, "/data"); err != nil {
+		t.Fatal(err)
+	}
+
+	if list, _ := mem.List("", "", ""); len(list.Objects) != 0 {
+		t.Errorf("expected everything to be deleted, found %d objects", len(list.Objects))
+	}
+}
+
+// copyTrackingStore fails copies of one key and tracks how many copies run at once
+type copyTrackingStore struct {
+	ObjectStore
+	failKey string
+
+	mu                    sync.Mutex
+	inFlight, maxInFlight int
+}
+
+func (s *copyTrackingStore) Copy(srcKey, dstKey string, size int64) error {
+	s.mu.Lock()
+	s.inFlight++
+	if s.inFlight > s.maxInFlight {
+		s.maxInFlight = s.inFlight
+	}
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		s.inFlight--
+		s.mu.Unlock()
+	}()
+
+	time.Sleep(time.Millisecond)
+
+	if srcKey == s.failKey {
+		return errors.New("copy failed")
+	}
+
+	return s.ObjectStore.Copy(srcKey, dstKey, size)
+}
+
+func TestRenameFile(t *testing.T) {
+	mem := NewMemStore()
+	keys := []string{"data/", "data/a.txt", "data/a.txt.bak", "data/2017/", "archive/"}
+	for i := 0; i < 200; i++ {
+		keys = append(keys, fmt.Sprintf("data/2017/%03d.txt", i))
+	}
+
+	for _, key := range keys {
+		if err := mem.Put(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	count := func(prefix string) int {
+		d := &S3Driver{store: mem}
+		objects, err := d.listObjects(prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(objects)
+	}
+
+	cc := &testContext{path: "/"}
+	store := &copyTrackingStore{ObjectStore: mem, failKey: "data/2017/150.txt"}
+	d := &S3Driver{store: store}
+
+	// a failed copy removes the partial copy and keeps the original
+	if err := d.RenameFile(cc, "/data/2017", "/archive/2017"); err == nil {
+		t.Error("expected the rename to fail")
+	}
+
+	if n := count("archive/2017/"); n != 0 {
+		t.Errorf("expected the partial copy to be removed, found %d objects", n)
+	}
+
+	if n := count("data/2017/"); n != 201 {
+		t.Errorf("expected the original to be kept, found %d objects", n)
+	}
+
+	store.failKey = ""
+	if err := d.RenameFile(cc, "/data/2017", "/archive/2017"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := count("archive/2017/"); n != 201 {
+		t.Errorf("expected 201 renamed objects, found %d", n)
+	}
+
+	if n := count("data/2017/"); n != 0 {
+		t.Errorf("expected the original to be deleted, found %d objects", n)
+	}
+
+	if store.maxInFlight > renameConcurrency || store.maxInFlight < 2 {
+		t.Errorf("expected concurrent copies up to %d, saw %d", renameConcurrency, store.maxInFlight)
+	}
+
+	// only the file, not other keys starting with its name
+	if err := d.RenameFile(cc, "/data/a.txt", "/archive/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mem.Head("data/a.txt.bak"); err != nil {
+		t.Error("expected data/a.txt.bak to be kept")
+	}
+
+	if err := d.RenameFile(cc, "/archive", "/archive/sub"); err == nil {
+		t.Error("expected an error moving a directory inside itself")
+	}
+
+	// renaming onto an existing directory merges them, a failed merge keeps what was already there
+	for _, key := range []string{"logs/", "logs/old.txt", "logs/b.txt", "old/", "old/a.txt", "old/b.txt", "old/c.txt"} {
+		if err := mem.Put(key, strings.NewReader(key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	store.failKey = "old/c.txt"
+	if err := d.RenameFile(cc, "/old", "/logs"); err == nil {
+		t.Error("expected the rename to fail")
+	}
+
+	for key, kept := range map[string]bool{"logs/": true, "logs/old.txt": true, "logs/b.txt": true, "logs/a.txt": false} {
+		if _, err := mem.Head(key); (err == nil) != kept {
+			t.Errorf("%s: expected kept %t after a failed merge, got err: %v", key, kept, err)
+		}
+	}
+
+	store.failKey = ""
+	if err := d.RenameFile(cc, "/old", "/logs"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := count("logs/"); n != 5 {
+		t.Errorf("expected 5 objects in the merged directory, found %d", n)
+	}
+
+	if n := count("old/"); n != 0 {
+		t.Errorf("expected the original to be deleted, found %d objects", n)
+	}
+}
+
+func TestGetFileHash(t *testing.T) {
+	// a checksum stored with the object is used rather than reading it
+	mem := NewMemStore()
+	if err := mem.PutWithMetadata("data.txt", strings.NewReader("some text"),
+		map[string]string{checksumSHA256: "0123abcd"}); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		algorithm server.HashAlgorithm
+		expected  string
+	}{
+		{server.HashMD5, "552e21cd4cd9918678e3c1a0df491bc3"},
+		{server.HashSHA1, "37aa63c77398d954473262e1a0057c1e632eda77"},
+		{server.HashSHA256, "0123abcd"},
+		{server.HashCRC32, "4fbabdba"},
+	}
+
+	d := &S3Driver{store: mem}
+	for _, tc := range testCases {
+		t.Run(string(tc.algorithm), func(t *testing.T) {
+			h, err := d.GetFileHash(nil, "/data.txt", tc.algorithm)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if h != tc.expected {
+				t.Errorf("expected %s got %s", tc.expected, h)
+			}
+		})
+	}
+
+	if _, err := d.GetFileHash(nil, "/missing.txt", server.HashMD5); err == nil {
+		t.Error("expected an error hashing a missing file")
+	}
+
+	if _, err := d.GetFileHash(nil, "/data.txt", "SHA-512"); err == nil {
+		t.Error("expected an error for an unsupported algorithm")
+	}
+}
+
+func TestFactPerm(t *testing.T) {
+	testCases := []struct {
+		permissions     []string
+		file, directory string
+	}{
+		{nil, "adfrw", "cdeflmp"},
+		{[]string{"read-only"}, "r", "el"},
+		{[]string{"drop-box"}, "", "cem"},
+		{[]string{"no-delete", "no-rename"}, "arw", "celm"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(strings.Join(tc.permissions, ","), func(t *testing.T) {
+			users, err := NewUserStore(&User{Name: "wgtn", Password: "secret1", Permissions: tc.permissions})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			cd, err := (&S3Driver{users: users}).AuthUser(nil, "wgtn", "secret1")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d := cd.(*S3Driver)
+			if perm := d.factPerm(false); perm != tc.file {
+				t.Errorf("expected file perm %q got %q", tc.file, perm)
+			}
+
+			if perm := d.factPerm(true); perm != tc.directory {
+				t.Errorf("expected directory perm %q got %q", tc.directory, perm)
+			}
+		})
+	}
+}
@@ -1,37 +1,55 @@
 package main
 
 // This implements the necessary functions to satisfy the following interfaces needed for ftpserver:
-// io.Writer, io.Reader, io.Closer, io.Seeker (stubbed out, we won't use it).  S3 manager requires only the io.Reader interface.
+// io.Writer, io.Reader, io.Closer, io.Seeker (to resume transfers).  S3 manager requires only the io.Reader interface.
 
 import (
+	"bytes"
 	"errors"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"fmt"
+	"github.com/fclairamb/ftpserver/server"
 	"io"
+	"log"
 	"os"
 	"time"
 )
 
 type S3VirtualFile struct {
 	flag         int
-	s3Session    *session.Session
-	s3Client     *s3.S3
+	store        ObjectStore
 	s3Path       string // the S3 key
 	s3WriterOpen bool   // only write to S3 if we've seen this flag
 	s3ReaderOpen bool
-	s3FileOutput *s3.GetObjectOutput
+	body         io.ReadCloser // the object being read
+	info         *ObjectInfo   // the object being read
+	verify       *checksums    // checks the object being read is complete and correct, nil if it can't be checked
+	sums         *checksums    // the checksums of the upload to store with the object, nil if they aren't stored
 	readPipe     *io.PipeReader
 	writePipe    *io.PipeWriter
 	uploadErr    chan error
+
+	// with uploads set, writes go to a multipart upload that is kept if the transfer is interrupted so it can be
+	// resumed (REST then STOR).  The upload is started by the first write so that Seek can pick the one to resume.
+	uploads       MultipartStore
+	uploadID      string
+	parts         []Part // the parts of the upload being resumed
+	uploadStarted bool
 }
 
-func NewS3VirtualFile(path string, flag int, session *session.Session, client *s3.S3) (*S3VirtualFile, error) {
+// NewS3VirtualFile opens an object for reading or writing.  Pass a MultipartStore as uploads to make interrupted
+// uploads resumable, otherwise nil.  The checksums (eg: "md5") of uploads are stored with the objects, if the store
+// supports metadata, and downloads are checked against them.
+func NewS3VirtualFile(path string, flag int, store ObjectStore, uploads MultipartStore,
+	checksums []string) (*S3VirtualFile, error) {
 	f := &S3VirtualFile{
-		flag:      flag,
-		s3Path:    path,
-		s3Session: session,
-		s3Client:  client,
+		flag:    flag,
+		s3Path:  path,
+		store:   store,
+		uploads: uploads,
+	}
+
+	if _, ok := store.(MetadataStore); ok {
+		f.sums = newChecksums(checksums)
 	}
 
 	f.readPipe, f.writePipe = io.Pipe()
@@ -41,46 +59,50 @@ func NewS3VirtualFile(path string, flag int, session *session.Session, client *s
 	var err error
 	if flag == os.O_RDONLY {
 		// read only doesn't need to modify the file
-		params := &s3.GetObjectInput{
-			Bucket: &S3_BUCKET_NAME,
-			Key:    &f.s3Path,
+		if f.body, f.info, err = f.store.Get(f.s3Path, 0); err != nil {
+			return nil, err
 		}
 
-		if f.s3FileOutput, err = f.s3Client.GetObject(params); err != nil {
-			return nil, stripNewlines(err)
-		}
+		f.verify = downloadChecksums(f.info)
 
 		f.s3ReaderOpen = true
 
-	} else {
-
-		// use PutObject to create an empty object.  This will report any errors before we write
-		params := &s3.PutObjectInput{
-			Bucket: &S3_BUCKET_NAME,
-			Key:    &f.s3Path,
+	} else if flag&os.O_APPEND != 0 {
+		// appending to a file that doesn't exist creates it
+		var info *ObjectInfo
+		if info, err = f.store.Head(f.s3Path); err != nil && !isNoSuchKey(err) {
+			return nil, err
 		}
 
-		if _, err := f.s3Client.PutObject(params); err != nil {
-			return nil, stripNewlines(err)
-		}
+		f.s3WriterOpen = true
+		f.uploadStarted = true
+
+		go func() {
+
+			defer f.readPipe.Close()
+
+			f.uploadErr <- f.appendTo(info)
+
+		}()
+
+	} else if f.uploads != nil {
+		// resumable uploads start on the first write
+		f.s3WriterOpen = true
+
+	} else {
+
+		// the object is replaced when the upload finishes (S3 doesn't show an upload until it's complete), so it isn't
+		// seen part written and a failed upload leaves the previous version in place
 
 		// using a go routine to avoid deadlock waiting on Write
 		f.s3WriterOpen = true
+		f.uploadStarted = true
 
 		go func() {
 
 			defer f.readPipe.Close()
 
-			// Using s3manager because PutObject requires a ReadSeeker which we can't have with unbuffered input
-			uploader := s3manager.NewUploader(f.s3Session)
-			upParams := &s3manager.UploadInput{
-				Bucket: &S3_BUCKET_NAME,
-				Key:    &f.s3Path,
-				Body:   f.readPipe,
-			}
-
-			_, err := uploader.Upload(upParams)
-			f.uploadErr <- stripNewlines(err)
+			f.uploadErr <- f.withChecksums(f.readPipe, f.put)
 
 		}()
 	}
@@ -91,10 +113,15 @@ func NewS3VirtualFile(path string, flag int, session *session.Session, client *s
 func (f *S3VirtualFile) Close() error {
 
 	if f.s3ReaderOpen {
-		f.s3FileOutput.Body.Close()
+		f.body.Close()
 	}
 
 	if f.s3WriterOpen {
+		// an empty file is an upload with no writes
+		if err := f.startUpload(); err != nil {
+			return err
+		}
+
 		f.writePipe.Close()
 
 		// waiting on this channel means we wait for the goroutine to finish uploading and check for error
@@ -106,16 +133,72 @@ func (f *S3VirtualFile) Close() error {
 	return nil
 }
 
+// Abort is called by the FTP server instead of Close when an upload fails part way.  The upload isn't completed, so a
+// resumable upload is kept to be continued later and other uploads fail.
+func (f *S3VirtualFile) Abort(err error) error {
+	if !f.s3WriterOpen {
+		return f.Close()
+	}
+
+	f.writePipe.CloseWithError(err)
+
+	if f.uploadStarted {
+		<-f.uploadErr
+	}
+
+	return err
+}
+
 func (f *S3VirtualFile) Read(buffer []byte) (int, error) {
 	if !f.s3ReaderOpen {
 		return 0, errors.New("Unable to read from pipe")
 	}
 
-	return f.s3FileOutput.Body.Read(buffer)
+	n, err := f.body.Read(buffer)
+
+	if f.verify != nil {
+		f.verify.Write(buffer[:n])
+
+		// don't report the end of the file if it isn't what was uploaded
+		if err == io.EOF {
+			if verifyErr := f.verify.verify(f.info); verifyErr != nil {
+				return n, verifyErr
+			}
+		}
+	}
+
+	return n, err
 }
 
+// Seek supports resuming downloads (REST before RETR) by reopening the object from the offset with a ranged GET, and
+// resuming interrupted uploads (REST before STOR) from the end of the data already uploaded.
 func (f *S3VirtualFile) Seek(n int64, w int) (int64, error) {
-	return 0, errors.New("Unable to seek in an S3 object")
+	if f.s3WriterOpen && f.uploads != nil && !f.uploadStarted && w == io.SeekStart {
+		return n, f.resumeUpload(n)
+	}
+
+	if !f.s3ReaderOpen || w != io.SeekStart {
+		return 0, errors.New("Unable to seek in an S3 object")
+	}
+
+	if n < 0 || n > f.info.Size {
+		return 0, fmt.Errorf("Invalid offset %d for an object of %d bytes", n, f.info.Size)
+	}
+
+	body, _, err := f.store.Get(f.s3Path, n)
+	if err != nil {
+		return 0, err
+	}
+
+	f.body.Close()
+	f.body = body
+
+	// only the whole object can be checked
+	if n != 0 {
+		f.verify = nil
+	}
+
+	return n, nil
 }
 
 func (f *S3VirtualFile) Write(buffer []byte) (int, error) {
@@ -124,9 +207,148 @@ func (f *S3VirtualFile) Write(buffer []byte) (int, error) {
 		return 0, errors.New("Unable to write to pipe")
 	}
 
+	if err := f.startUpload(); err != nil {
+		return 0, err
+	}
+
 	return f.writePipe.Write(buffer)
 }
 
+// appendTo writes the object followed by what's written to the file, or just what's written if the object (info)
+// doesn't exist
+func (f *S3VirtualFile) appendTo(info *ObjectInfo) error {
+	if info == nil {
+		return f.withChecksums(f.readPipe, f.put)
+	}
+
+	if uploads, ok := f.store.(MultipartStore); ok && info.Size >= appendCopyMinSize {
+		f.dropChecksums("the existing data isn't read")
+		return appendUpload(uploads, f.s3Path, info.Size, f.readPipe)
+	}
+
+	existing, _, err := f.store.Get(f.s3Path, 0)
+	if err != nil {
+		return err
+	}
+	defer existing.Close()
+
+	return f.withChecksums(io.MultiReader(existing, f.readPipe), f.put)
+}
+
+// withChecksums uploads body with its checksums if they're being stored.  They're sent with the upload so the object
+// has them from when it's created, which means knowing them before the upload starts.  Up to uploadPartSize of body is
+// held in memory to work them out, and a body that fits is sent in one request that the store checks against its MD5.
+//
+// A larger body is passed to upload.  S3 can't add metadata to an object without copying it, so the object doesn't
+// get the checksums, but if the store has multipart uploads it's checked against the MD5s of its parts (see put).
+func (f *S3VirtualFile) withChecksums(body io.Reader, upload func(io.Reader) error) error {
+	_, multipart := f.store.(MultipartStore)
+	if f.sums == nil && !multipart {
+		return upload(body)
+	}
+
+	var buf bytes.Buffer
+	var err error
+	if f.sums != nil {
+		_, err = io.CopyN(&buf, f.sums.reader(body), int64(uploadPartSize)+1)
+	} else {
+		_, err = io.CopyN(&buf, body, int64(uploadPartSize)+1)
+	}
+
+	switch err {
+	case io.EOF:
+		if f.sums != nil {
+			return f.store.(MetadataStore).PutWithMetadata(f.s3Path, &buf, f.sums.metadata())
+		}
+
+		return f.store.Put(f.s3Path, &buf)
+	case nil:
+		f.dropChecksums(fmt.Sprintf("it's larger than %d bytes", uploadPartSize))
+		return upload(io.MultiReader(&buf, body))
+	}
+
+	return err
+}
+
+// dropChecksums stops working out the checksums of an upload that can't have them stored, logging why
+func (f *S3VirtualFile) dropChecksums(reason string) {
+	if f.sums != nil {
+		log.Printf("the checksums of %s aren't stored because %s", f.s3Path, reason)
+		f.sums = nil
+	}
+}
+
+// put uploads body to the object, as a multipart upload that's checked against the MD5s of its parts if the store
+// has them
+func (f *S3VirtualFile) put(body io.Reader) error {
+	if uploads, ok := f.store.(MultipartStore); ok {
+		return multipartUpload(uploads, f.s3Path, body)
+	}
+
+	return f.store.Put(f.s3Path, body)
+}
+
+// newUpload uploads body to the object with a new multipart upload
+func (f *S3VirtualFile) newUpload(body io.Reader) error {
+	uploadID, err := f.uploads.CreateUpload(f.s3Path)
+	if err != nil {
+		return err
+	}
+
+	return uploadParts(f.uploads, f.s3Path, uploadID, nil, body)
+}
+
+// resumeUpload continues the interrupted upload to the file, which must have offset bytes uploaded
+func (f *S3VirtualFile) resumeUpload(offset int64) error {
+	upload, parts, err := pendingUpload(f.uploads, f.s3Path)
+	if err != nil {
+		return err
+	}
+
+	if size := partsSize(parts); upload == nil || size != offset {
+		return fmt.Errorf("Can't resume the upload from %d bytes, %d bytes have been received", offset, size)
+	}
+
+	f.uploadID = upload.ID
+	f.parts = parts
+
+	return nil
+}
+
+// startUpload starts uploading a resumable upload in the background, if it hasn't been started yet
+func (f *S3VirtualFile) startUpload() error {
+	if f.uploadStarted {
+		return nil
+	}
+
+	if f.uploadID == "" {
+		// uploading the file again from the start replaces any interrupted uploads
+		if err := abortUploads(f.uploads, f.s3Path); err != nil {
+			return err
+		}
+	}
+
+	f.uploadStarted = true
+
+	go func() {
+
+		defer f.readPipe.Close()
+
+		if f.uploadID == "" {
+			f.uploadErr <- f.withChecksums(f.readPipe, f.newUpload)
+			return
+		}
+
+		// a resumed upload only has the rest of the file so there aren't checksums to store.  It's still checked
+		// against the ETags of the parts.
+		f.dropChecksums("the upload was resumed")
+		f.uploadErr <- uploadParts(f.uploads, f.s3Path, f.uploadID, f.parts, f.readPipe)
+
+	}()
+
+	return nil
+}
+
 type fakeInfo struct {
 	name    string
 	size    int64
@@ -134,6 +356,8 @@ type fakeInfo struct {
 	modTime time.Time
 	isDir   bool
 	sys     interface{}
+	perm    string // the MLSD and MLST perm fact
+	unique  string // the MLSD and MLST unique fact
 }
 
 func (fi fakeInfo) Name() string {
@@ -159,3 +383,13 @@ func (fi fakeInfo) IsDir() bool {
 func (fi fakeInfo) Sys() interface{} {
 	return nil
 }
+
+func (fi fakeInfo) Perm() string {
+	return fi.perm
+}
+
+func (fi fakeInfo) Unique() string {
+	return fi.unique
+}
+
+var _ server.FileInfoFacts = fakeInfo{}
@@ -0,0 +1,699 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"io"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// S3Config is the connection settings for S3 or an S3 compatible object store (eg: MinIO or Ceph).  Zero values use
+// the AWS SDK defaults, which include the AWS_REGION and credentials environment variables.
+type S3Config struct {
+	Endpoint       string // eg: "https://minio.example.com:9000"
+	Region         string
+	ForcePathStyle bool   // use "endpoint/bucket/key" URLs instead of "bucket.endpoint/key"
+	DisableSSL     bool   // use http when the endpoint doesn't include a scheme
+	CABundle       string // file with PEM encoded CA certificates to trust instead of the system roots
+}
+
+func newS3Session(c S3Config) (*session.Session, error) {
+	config := aws.NewConfig()
+
+	if c.Endpoint != "" {
+		config = config.WithEndpoint(c.Endpoint)
+	}
+
+	if c.Region != "" {
+		config = config.WithRegion(c.Region)
+	}
+
+	if c.ForcePathStyle {
+		config = config.WithS3ForcePathStyle(true)
+	}
+
+	if c.DisableSSL {
+		config = config.WithDisableSSL(true)
+	}
+
+	opts := session.Options{Config: *config}
+
+	if c.CABundle != "" {
+		b, err := ioutil.ReadFile(c.CABundle)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading S3 CA bundle: %s", err)
+		}
+
+		opts.CustomCABundle = bytes.NewReader(b)
+	}
+
+	s3Session, err := session.NewSessionWithOptions(opts)
+	if err != nil {
+		return nil, fmt.Errorf("error creating S3 session: %s", err)
+	}
+
+	return s3Session, nil
+}
+
+const (
+	// the most keys S3 accepts in a DeleteObjects request
+	s3MaxDeleteKeys = 1000
+	// the number of DeleteObjects requests to run at once when deleting more than s3MaxDeleteKeys
+	s3DeleteConcurrency = 4
+
+	// the largest object CopyObject can copy, larger objects are copied in parts with UploadPartCopy
+	s3MaxCopySize = 5 * 1024 * 1024 * 1024
+	// the size of each part in a multipart copy (S3 allows up to 10000 parts of 5MB to 5GB)
+	s3CopyPartSize = 512 * 1024 * 1024
+	s3MaxParts     = 10000
+	// the number of UploadPartCopy requests to run at once
+	s3CopyPartConcurrency = 8
+)
+
+// S3Store is the ObjectStore for an S3 bucket, using the AWS SDK
+type S3Store struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+}
+
+func NewS3Store(s3Session *session.Session, bucket string) *S3Store {
+	return &S3Store{
+		client: s3.New(s3Session),
+		// Using s3manager because PutObject requires a ReadSeeker which we can't have with unbuffered input
+		uploader: s3manager.NewUploader(s3Session, s3manager.WithUploaderRequestOptions(withContentMD5)),
+		bucket:   bucket,
+	}
+}
+
+func (s *S3Store) List(prefix, delimiter, continuationToken string) (*ObjectList, error) {
+	params := &s3.ListObjectsV2Input{
+		Bucket: &s.bucket,
+		Prefix: &prefix,
+	}
+
+	// an empty delimiter makes the listing recursive
+	if delimiter != "" {
+		params.Delimiter = &delimiter
+	}
+
+	if continuationToken != "" {
+		params.ContinuationToken = &continuationToken
+	}
+
+	resp, err := s.client.ListObjectsV2(params)
+	if err != nil {
+		return nil, stripNewlines(err)
+	}
+
+	list := &ObjectList{}
+
+	for _, p := range resp.CommonPrefixes {
+		list.CommonPrefixes = append(list.CommonPrefixes, *p.Prefix)
+	}
+
+	for _, o := range resp.Contents {
+		info := ObjectInfo{Key: *o.Key}
+		if o.Size != nil {
+			info.Size = *o.Size
+		}
+		if o.LastModified != nil {
+			info.LastModified = *o.LastModified
+		}
+		list.Objects = append(list.Objects, info)
+	}
+
+	// AWS using pointers to bools (?!) so need to check for nil
+	if resp.IsTruncated != nil && *resp.IsTruncated && resp.NextContinuationToken != nil {
+		list.NextContinuationToken = *resp.NextContinuationToken
+	}
+
+	return list, nil
+}
+
+func (s *S3Store) Head(key string) (*ObjectInfo, error) {
+	params := &s3.HeadObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	}
+
+	resp, err := s.client.HeadObject(params)
+	if err != nil {
+		return nil, stripNewlines(err)
+	}
+
+	info := &ObjectInfo{Key: key, Metadata: aws.StringValueMap(resp.Metadata)}
+	if resp.ContentLength != nil {
+		info.Size = *resp.ContentLength
+	}
+
+	if resp.LastModified != nil {
+		info.LastModified = *resp.LastModified
+	}
+
+	info.ETag = objectETag(resp.ETag, resp.ServerSideEncryption, resp.SSECustomerAlgorithm)
+
+	return info, nil
+}
+
+func (s *S3Store) Get(key string, offset int64) (io.ReadCloser, *ObjectInfo, error) {
+	if offset < 0 {
+		return nil, nil, errInvalidOffset
+	}
+
+	params := &s3.GetObjectInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	}
+
+	if offset > 0 {
+		rng := fmt.Sprintf("bytes=%d-", offset)
+		params.Range = &rng
+	}
+
+	resp, err := s.client.GetObject(params)
+	if err != nil {
+		// S3 won't return an empty range so resuming a download that had finished is a special case
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "InvalidRange" {
+			return s.emptyRange(key, offset)
+		}
+
+		return nil, nil, stripNewlines(err)
+	}
+
+	// resp.ContentLength and resp.LastModified are sometimes nil (!) so check for this state.  Aws!
+	info := &ObjectInfo{Key: key, Metadata: aws.StringValueMap(resp.Metadata)}
+	if resp.ContentLength != nil {
+		info.Size = *resp.ContentLength
+	}
+
+	// the size of the whole object is in the range, eg: "bytes 100-199/200"
+	if resp.ContentRange != nil {
+		if i := strings.LastIndex(*resp.ContentRange, "/"); i >= 0 {
+			if size, err := strconv.ParseInt((*resp.ContentRange)[i+1:], 10, 64); err == nil {
+				info.Size = size
+			}
+		}
+	}
+
+	if resp.LastModified != nil {
+		info.LastModified = *resp.LastModified
+	}
+
+	info.ETag = objectETag(resp.ETag, resp.ServerSideEncryption, resp.SSECustomerAlgorithm)
+
+	return resp.Body, info, nil
+}
+
+// emptyRange is Get for an offset S3 says isn't in the object.  That's fine if it's the end of the object.
+func (s *S3Store) emptyRange(key string, offset int64) (io.ReadCloser, *ObjectInfo, error) {
+	info, err := s.Head(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if offset != info.Size {
+		return nil, nil, errInvalidOffset
+	}
+
+	return ioutil.NopCloser(strings.NewReader("")), info, nil
+}
+
+func (s *S3Store) Put(key string, body io.Reader) error {
+	return s.PutWithMetadata(key, body, nil)
+}
+
+// PutWithMetadata uploads the object with s3manager, which sends it with PutObject or as a multipart upload depending
+// on its size.  Each request has the MD5 of its body so S3 rejects anything that doesn't arrive intact, before the
+// object is created.
+func (s *S3Store) PutWithMetadata(key string, body io.Reader, metadata map[string]string) error {
+	params := &s3manager.UploadInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+		Body:   body,
+	}
+
+	if len(metadata) > 0 {
+		params.Metadata = aws.StringMap(metadata)
+	}
+
+	_, err := s.uploader.Upload(params)
+	return stripNewlines(err)
+}
+
+func (s *S3Store) Copy(srcKey, dstKey string, size int64) error {
+	if size > s3MaxCopySize {
+		return s.multipartCopy(srcKey, dstKey, size)
+	}
+
+	copySrc := s.bucket + "/" + srcKey
+	params := &s3.CopyObjectInput{
+		Bucket:     &s.bucket,
+		Key:        &dstKey,
+		CopySource: &copySrc,
+	}
+
+	_, err := s.client.CopyObject(params)
+	return stripNewlines(err)
+}
+
+// multipartCopy copies an object too large for CopyObject by copying byte ranges of it into the parts of a multipart
+// upload.  Like CopyObject the copy has the source's content type and metadata (eg: its checksums), which are looked
+// up first because a multipart upload starts without them.  The upload is aborted if any part fails.
+func (s *S3Store) multipartCopy(srcKey, dstKey string, size int64) error {
+	head, err := s.client.HeadObject(&s3.HeadObjectInput{Bucket: &s.bucket, Key: &srcKey})
+	if err != nil {
+		return stripNewlines(err)
+	}
+
+	create, err := s.client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket:      &s.bucket,
+		Key:         &dstKey,
+		ContentType: head.ContentType,
+		Metadata:    head.Metadata,
+	})
+	if err != nil {
+		return stripNewlines(err)
+	}
+
+	partSize := int64(s3CopyPartSize)
+	if size/partSize >= s3MaxParts {
+		partSize = size/s3MaxParts + 1
+	}
+
+	copySrc := s.bucket + "/" + srcKey
+	parts := make([]*s3.CompletedPart, (size+partSize-1)/partSize)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var copyErr error
+
+	sem := make(chan bool, s3CopyPartConcurrency)
+
+	for i := range parts {
+		mu.Lock()
+		failed := copyErr != nil
+		mu.Unlock()
+
+		if failed {
+			break
+		}
+
+		wg.Add(1)
+		sem <- true
+
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			start := int64(i) * partSize
+			end := start + partSize - 1
+			if end >= size {
+				end = size - 1
+			}
+
+			partNumber := int64(i + 1)
+			copyRange := fmt.Sprintf("bytes=%d-%d", start, end)
+
+			resp, err := s.client.UploadPartCopy(&s3.UploadPartCopyInput{
+				Bucket:          &s.bucket,
+				Key:             &dstKey,
+				CopySource:      &copySrc,
+				CopySourceRange: &copyRange,
+				PartNumber:      &partNumber,
+				UploadId:        create.UploadId,
+			})
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err == nil && resp.CopyPartResult == nil {
+				err = fmt.Errorf("no result copying part %d of %s", partNumber, srcKey)
+			}
+
+			if err != nil {
+				if copyErr == nil {
+					copyErr = stripNewlines(err)
+				}
+				return
+			}
+
+			parts[i] = &s3.CompletedPart{ETag: resp.CopyPartResult.ETag, PartNumber: &partNumber}
+		}(i)
+	}
+
+	wg.Wait()
+
+	if copyErr == nil {
+		_, copyErr = s.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+			Bucket:          &s.bucket,
+			Key:             &dstKey,
+			UploadId:        create.UploadId,
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+		})
+
+		if copyErr == nil {
+			return nil
+		}
+
+		copyErr = stripNewlines(copyErr)
+	}
+
+	// don't leave the parts behind, S3 charges for them until the upload is aborted
+	if _, err = s.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   &s.bucket,
+		Key:      &dstKey,
+		UploadId: create.UploadId,
+	}); err != nil {
+		log.Printf("error aborting multipart copy of %s to %s: %s", srcKey, dstKey, stripNewlines(err))
+	}
+
+	return copyErr
+}
+
+func (s *S3Store) Delete(keys []string) error {
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var requestErr error
+	var deleteErrs DeleteErrors
+
+	sem := make(chan bool, s3DeleteConcurrency)
+
+	// DeleteObjects takes up to s3MaxDeleteKeys at a time
+	for start := 0; start < len(keys); start += s3MaxDeleteKeys {
+		end := start + s3MaxDeleteKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		wg.Add(1)
+		sem <- true
+
+		go func(chunk []string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			errs, err := s.deleteChunk(chunk)
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			if err != nil && requestErr == nil {
+				requestErr = err
+			}
+			deleteErrs = append(deleteErrs, errs...)
+		}(keys[start:end])
+	}
+
+	wg.Wait()
+
+	if requestErr != nil {
+		return requestErr
+	}
+
+	if len(deleteErrs) > 0 {
+		return deleteErrs
+	}
+
+	return nil
+}
+
+// deleteChunk deletes up to s3MaxDeleteKeys objects in one request.  S3 reports objects that couldn't be deleted in
+// the response rather than failing the request.
+func (s *S3Store) deleteChunk(keys []string) (DeleteErrors, error) {
+	var objects []*s3.ObjectIdentifier
+	for i := range keys {
+		objects = append(objects, &s3.ObjectIdentifier{Key: &keys[i]})
+	}
+
+	quiet := true // only return the errors, not every deleted key
+	params := &s3.DeleteObjectsInput{
+		Bucket: &s.bucket,
+		Delete: &s3.Delete{Objects: objects, Quiet: &quiet},
+	}
+
+	resp, err := s.client.DeleteObjects(params)
+	if err != nil {
+		return nil, stripNewlines(err)
+	}
+
+	var errs DeleteErrors
+	for _, e := range resp.Errors {
+		var d DeleteError
+		if e.Key != nil {
+			d.Key = *e.Key
+		}
+		if e.Code != nil {
+			d.Code = *e.Code
+		}
+		if e.Message != nil {
+			d.Message = strings.Replace(*e.Message, "\n", "", -1)
+		}
+		errs = append(errs, d)
+	}
+
+	return errs, nil
+}
+
+func (s *S3Store) Uploads(prefix string) ([]Upload, error) {
+	var uploads []Upload
+
+	err := s.client.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: &s.bucket,
+		Prefix: &prefix,
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, u := range page.Uploads {
+			if u.Key == nil || u.UploadId == nil {
+				continue
+			}
+
+			upload := Upload{Key: *u.Key, ID: *u.UploadId}
+			if u.Initiated != nil {
+				upload.Initiated = *u.Initiated
+			}
+			uploads = append(uploads, upload)
+		}
+		return true
+	})
+	if err != nil {
+		return nil, stripNewlines(err)
+	}
+
+	return uploads, nil
+}
+
+func (s *S3Store) CreateUpload(key string) (string, error) {
+	resp, err := s.client.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+		Bucket: &s.bucket,
+		Key:    &key,
+	})
+	if err != nil {
+		return "", stripNewlines(err)
+	}
+
+	if resp.UploadId == nil {
+		return "", fmt.Errorf("no upload id creating an upload to %s", key)
+	}
+
+	return *resp.UploadId, nil
+}
+
+// UploadPart sends the part with its MD5 for S3 to check, and checks the ETag S3 returns is the MD5 too (unless the
+// part is encrypted with KMS or a customer key)
+func (s *S3Store) UploadPart(key, uploadID string, partNumber int, body io.ReadSeeker) (string, error) {
+	n := int64(partNumber)
+
+	h := md5.New()
+	if _, err := io.Copy(h, body); err != nil {
+		return "", err
+	}
+
+	if _, err := body.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	sum := h.Sum(nil)
+
+	req, resp := s.client.UploadPartRequest(&s3.UploadPartInput{
+		Bucket:     &s.bucket,
+		Key:        &key,
+		UploadId:   &uploadID,
+		PartNumber: &n,
+		Body:       body,
+	})
+
+	// this version of the SDK doesn't have a ContentMD5 field for UploadPart
+	req.Handlers.Build.PushBack(func(r *request.Request) {
+		r.HTTPRequest.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(sum))
+	})
+
+	if err := req.Send(); err != nil {
+		return "", stripNewlines(err)
+	}
+
+	etag := objectETag(resp.ETag, resp.ServerSideEncryption, resp.SSECustomerAlgorithm)
+	if etag != "" && !strings.EqualFold(etag, hex.EncodeToString(sum)) {
+		return "", fmt.Errorf("Checksum mismatch uploading part %d of %s: S3 has ETag %s but %x was sent", partNumber,
+			key, etag, sum)
+	}
+
+	return strings.Trim(aws.StringValue(resp.ETag), `"`), nil
+}
+
+func (s *S3Store) CopyPart(key, uploadID string, partNumber int, srcKey string, offset, size int64) (string, error) {
+	n := int64(partNumber)
+	copySrc := s.bucket + "/" + srcKey
+	copyRange := fmt.Sprintf("bytes=%d-%d", offset, offset+size-1)
+
+	resp, err := s.client.UploadPartCopy(&s3.UploadPartCopyInput{
+		Bucket:          &s.bucket,
+		Key:             &key,
+		UploadId:        &uploadID,
+		PartNumber:      &n,
+		CopySource:      &copySrc,
+		CopySourceRange: &copyRange,
+	})
+	if err != nil {
+		return "", stripNewlines(err)
+	}
+
+	if resp.CopyPartResult == nil {
+		return "", fmt.Errorf("no result copying part %d of %s", partNumber, srcKey)
+	}
+
+	return strings.Trim(aws.StringValue(resp.CopyPartResult.ETag), `"`), nil
+}
+
+func (s *S3Store) Parts(key, uploadID string) ([]Part, error) {
+	parts, err := s.listParts(key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+
+	var p []Part
+	for _, part := range parts {
+		etag := strings.Trim(aws.StringValue(part.ETag), `"`)
+		p = append(p, Part{Number: int(*part.PartNumber), Size: *part.Size, ETag: etag})
+	}
+
+	return p, nil
+}
+
+// CompleteUpload sends the parts with their ETags, S3 fails the request if they aren't the parts it has
+func (s *S3Store) CompleteUpload(key, uploadID string, parts []Part) (string, error) {
+	completed := make([]*s3.CompletedPart, len(parts))
+	for i, part := range parts {
+		completed[i] = &s3.CompletedPart{ETag: aws.String(`"` + part.ETag + `"`), PartNumber: aws.Int64(int64(part.Number))}
+	}
+
+	resp, err := s.client.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          &s.bucket,
+		Key:             &key,
+		UploadId:        &uploadID,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return "", stripNewlines(err)
+	}
+
+	return objectETag(resp.ETag, resp.ServerSideEncryption, nil), nil
+}
+
+func (s *S3Store) AbortUpload(key, uploadID string) error {
+	_, err := s.client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   &s.bucket,
+		Key:      &key,
+		UploadId: &uploadID,
+	})
+
+	return stripNewlines(err)
+}
+
+// listParts returns the parts of an upload in number order, skipping any S3 returns without a number or size
+func (s *S3Store) listParts(key, uploadID string) ([]*s3.Part, error) {
+	var parts []*s3.Part
+
+	err := s.client.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   &s.bucket,
+		Key:      &key,
+		UploadId: &uploadID,
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			if part.PartNumber != nil && part.Size != nil {
+				parts = append(parts, part)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, stripNewlines(err)
+	}
+
+	return parts, nil
+}
+
+// objectETag returns an object's ETag without the quotes.  It's empty if the object is encrypted with KMS or a
+// customer key, their ETags aren't the MD5 of the object.
+func objectETag(etag, sse, sseCustomerAlgorithm *string) string {
+	if etag == nil || aws.StringValue(sse) == s3.ServerSideEncryptionAwsKms || sseCustomerAlgorithm != nil {
+		return ""
+	}
+
+	return strings.Trim(*etag, `"`)
+}
+
+// withContentMD5 is a request option that sends PutObject and UploadPart requests with the MD5 of their body, which
+// S3 checks the body against.  This version of the SDK doesn't have a ContentMD5 field for UploadPart.
+func withContentMD5(r *request.Request) {
+	switch r.Operation.Name {
+	case "PutObject", "UploadPart":
+		r.Handlers.Build.PushBack(setContentMD5)
+	}
+}
+
+func setContentMD5(r *request.Request) {
+	start, err := r.Body.Seek(0, io.SeekCurrent)
+	if err == nil {
+		h := md5.New()
+		if _, err = io.Copy(h, r.Body); err == nil {
+			_, err = r.Body.Seek(start, io.SeekStart)
+		}
+
+		r.HTTPRequest.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(h.Sum(nil)))
+	}
+
+	if err != nil {
+		r.Error = awserr.New("ContentMD5", "failed to read the body", err)
+	}
+}
+
+// AWS errors may include newlines that interfere with FTP commands so strip them out
+func stripNewlines(err error) error {
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok {
+			strippedMessage := strings.Replace(awsErr.Message(), "\n", "", -1)
+			return awserr.New(awsErr.Code(), strippedMessage, awsErr.OrigErr())
+		} else {
+			return err
+		}
+	}
+
+	return nil
+}
+
+var _ ObjectStore = &S3Store{}
+var _ MultipartStore = &S3Store{}
+var _ MetadataStore = &S3Store{}
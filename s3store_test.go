@@ -0,0 +1,514 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setTestCredentials sets dummy AWS credentials for the test S3 servers, the
+// returned func restores the environment.
+func setTestCredentials() func() {
+	restore := make(map[string]string)
+	for _, env := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY"} {
+		restore[env] = os.Getenv(env)
+		os.Setenv(env, "test")
+	}
+
+	return func() {
+		for env, value := range restore {
+			os.Setenv(env, value)
+		}
+	}
+}
+
+// newTestS3Store returns an S3Store for testbucket on a test server using handler.
+// Requests aren't retried.  The returned func closes the server and restores the
+// environment.
+func newTestS3Store(t *testing.T, handler http.Handler) (*S3Store, func()) {
+	restore := setTestCredentials()
+	srv := httptest.NewServer(handler)
+
+	cleanup := func() {
+		srv.Close()
+		restore()
+	}
+
+	s3Session, err := newS3Session(S3Config{Endpoint: srv.URL, Region: "us-east-1", ForcePathStyle: true})
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	s3Session.Config.MaxRetries = new(int)
+
+	return NewS3Store(s3Session, "testbucket"), cleanup
+}
+
+// an S3 compatible endpoint (eg: MinIO) with path style addressing and a private CA
+func TestS3StoreCustomEndpoint(t *testing.T) {
+	defer setTestCredentials()()
+
+	var requestPath string
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestPath = r.URL.Path
+		w.Write([]byte("some text"))
+	}))
+	defer srv.Close()
+
+	ca, err := ioutil.TempFile("", "bucketftp-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ca.Name())
+
+	if err = pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: srv.TLS.Certificates[0].Certificate[0]}); err != nil {
+		t.Fatal(err)
+	}
+	ca.Close()
+
+	config := S3Config{Endpoint: srv.URL, Region: "us-east-1", ForcePathStyle: true}
+
+	// the server's certificate isn't trusted without the CA bundle
+	s3Session, err := newS3Session(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = NewS3Store(s3Session, "testbucket").Get("dir/file.txt", 0); err == nil {
+		t.Error("expected an error connecting to a server with an untrusted certificate")
+	}
+
+	config.CABundle = ca.Name()
+	if s3Session, err = newS3Session(config); err != nil {
+		t.Fatal(err)
+	}
+
+	body, info, err := NewS3Store(s3Session, "testbucket").Get("dir/file.txt", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body.Close()
+
+	if requestPath != "/testbucket/dir/file.txt" {
+		t.Errorf("expected a path style request for /testbucket/dir/file.txt but got %s", requestPath)
+	}
+
+	if info.Size != int64(len("some text")) {
+		t.Errorf("unexpected object size %d", info.Size)
+	}
+
+	config.CABundle = "/missing/ca.pem"
+	if _, err = newS3Session(config); err == nil {
+		t.Error("expected an error loading a missing CA bundle")
+	}
+}
+
+// metadata lookups shouldn't download the object
+func TestS3StoreHead(t *testing.T) {
+	var methods []string
+	store, cleanup := newTestS3Store(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods = append(methods, r.Method)
+		w.Header().Set("Content-Length", "1234")
+		w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	}))
+	defer cleanup()
+
+	info, err := store.Head("dir/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(methods) != 1 || methods[0] != "HEAD" {
+		t.Errorf("expected a single HEAD request but saw %v", methods)
+	}
+
+	if info.Size != 1234 || info.LastModified.Year() != 2006 {
+		t.Errorf("unexpected object info %+v", info)
+	}
+}
+
+// downloads are resumed with a ranged GET, including from the end of the object
+func TestS3StoreRangedGet(t *testing.T) {
+	const object = "some text"
+
+	store, cleanup := newTestS3Store(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			w.Header().Set("Content-Length", fmt.Sprint(len(object)))
+			return
+		}
+
+		var start int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start); err != nil {
+			w.Write([]byte(object))
+			return
+		}
+
+		if start >= len(object) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			fmt.Fprint(w, "<Error><Code>InvalidRange</Code><Message>The requested range is not satisfiable</Message></Error>")
+			return
+		}
+
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(object)-1, len(object)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write([]byte(object[start:]))
+	}))
+	defer cleanup()
+
+	for _, offset := range []int64{0, 5, int64(len(object))} {
+		body, info, err := store.Get("dir/file.txt", offset)
+		if err != nil {
+			t.Fatalf("offset %d: %v", offset, err)
+		}
+
+		b, err := ioutil.ReadAll(body)
+		body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(b) != object[offset:] || info.Size != int64(len(object)) {
+			t.Errorf("offset %d: unexpected body %q size %d", offset, b, info.Size)
+		}
+	}
+
+	if _, _, err := store.Get("dir/file.txt", int64(len(object))+1); err != errInvalidOffset {
+		t.Errorf("expected an invalid offset error, got: %v", err)
+	}
+}
+
+// deletes are sent in batches of at most 1000 keys and per-key failures are reported
+func TestS3StoreDelete(t *testing.T) {
+	var mu sync.Mutex
+	var batches []int
+	var inFlight, maxInFlight int
+
+	store, cleanup := newTestS3Store(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		defer func() {
+			mu.Lock()
+			inFlight--
+			mu.Unlock()
+		}()
+
+		var req struct {
+			Objects []struct{ Key string } `xml:"Object"`
+		}
+
+		if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		// slow enough for the requests to overlap
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		batches = append(batches, len(req.Objects))
+		mu.Unlock()
+
+		fmt.Fprint(w, "<DeleteResult>")
+		for _, o := range req.Objects {
+			if strings.HasPrefix(o.Key, "locked/") {
+				fmt.Fprintf(w, "<Error><Key>%s</Key><Code>AccessDenied</Code><Message>Access Denied</Message></Error>", o.Key)
+			}
+		}
+		fmt.Fprint(w, "</DeleteResult>")
+	}))
+	defer cleanup()
+
+	var keys []string
+	for i := 0; i < 4500; i++ {
+		keys = append(keys, fmt.Sprintf("dir/%04d", i))
+	}
+	keys = append(keys, "locked/a", "locked/b")
+
+	err := store.Delete(keys)
+
+	deleteErrs, ok := err.(DeleteErrors)
+	if !ok {
+		t.Fatalf("expected DeleteErrors, got: %v", err)
+	}
+
+	if len(deleteErrs) != 2 || deleteErrs[0].Key != "locked/a" || deleteErrs[0].Code != "AccessDenied" {
+		t.Errorf("unexpected delete errors: %v", deleteErrs)
+	}
+
+	sort.Ints(batches)
+	if !reflect.DeepEqual(batches, []int{502, 1000, 1000, 1000, 1000}) {
+		t.Errorf("unexpected batch sizes: %v", batches)
+	}
+
+	if maxInFlight > s3DeleteConcurrency {
+		t.Errorf("expected at most %d concurrent requests, saw %d", s3DeleteConcurrency, maxInFlight)
+	}
+}
+
+// objects over 5GB are copied in parts
+func TestS3StoreMultipartCopy(t *testing.T) {
+	const size = 12*1024*1024*1024 + 1
+
+	var mu sync.Mutex
+	var ranges []string
+	var completed, aborted, copies int
+	var failPart string
+
+	store, cleanup := newTestS3Store(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		q := r.URL.Query()
+		_, uploads := q["uploads"]
+
+		switch {
+		case r.Method == "HEAD":
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Header().Set("Content-Length", fmt.Sprint(size))
+		case r.Method == "POST" && uploads:
+			fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>upload1</UploadId></InitiateMultipartUploadResult>")
+		case r.Method == "PUT" && q.Get("partNumber") != "":
+			if q.Get("uploadId") != "upload1" || r.Header.Get("X-Amz-Copy-Source") != "testbucket/big.mseed" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			if q.Get("partNumber") == failPart {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+
+			ranges = append(ranges, r.Header.Get("X-Amz-Copy-Source-Range"))
+			fmt.Fprintf(w, `<CopyPartResult><ETag>"etag%s"</ETag></CopyPartResult>`, q.Get("partNumber"))
+		case r.Method == "POST" && q.Get("uploadId") != "":
+			completed++
+			fmt.Fprint(w, "<CompleteMultipartUploadResult><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>")
+		case r.Method == "DELETE" && q.Get("uploadId") != "":
+			aborted++
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "PUT":
+			copies++
+			fmt.Fprint(w, "<CopyObjectResult><ETag>\"etag\"</ETag></CopyObjectResult>")
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer cleanup()
+
+	// small objects are copied in one request
+	if err := store.Copy("small.mseed", "copy.mseed", 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	if copies != 1 {
+		t.Errorf("expected a single CopyObject request, saw %d", copies)
+	}
+
+	if err := store.Copy("big.mseed", "archive/big.mseed", size); err != nil {
+		t.Fatal(err)
+	}
+
+	// the parts cover every byte of the object
+	parts := make(map[int64]int64)
+	for _, rng := range ranges {
+		var start, end int64
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || end < start {
+			t.Fatalf("unexpected copy range %s", rng)
+		}
+		parts[start] = end
+	}
+
+	var next int64
+	for {
+		end, ok := parts[next]
+		if !ok {
+			break
+		}
+		next = end + 1
+	}
+
+	if next != size || len(ranges) != 25 || completed != 1 {
+		t.Errorf("expected 25 parts up to byte %d and a completed upload, got %d parts up to %d, %d completed",
+			int64(size), len(ranges), next, completed)
+	}
+
+	// a failed part aborts the upload
+	failPart = "3"
+	if err := store.Copy("big.mseed", "archive/big.mseed", size); err == nil {
+		t.Error("expected the copy to fail")
+	}
+
+	if aborted != 1 || completed != 1 {
+		t.Errorf("expected the failed upload to be aborted, %d aborted and %d completed", aborted, completed)
+	}
+}
+
+// completing a resumable upload sends the parts with their ETags, and parts are checked against the ETag S3 returns
+func TestS3StoreUploads(t *testing.T) {
+	var completed []string
+	var partETag string
+
+	store, cleanup := newTestS3Store(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		_, uploads := q["uploads"]
+
+		switch {
+		case r.Method == "PUT" && q.Get("uploadId") == "upload1":
+			ioutil.ReadAll(r.Body)
+			w.Header().Set("ETag", `"`+partETag+`"`)
+		case r.Method == "GET" && uploads:
+			fmt.Fprint(w, "<ListMultipartUploadsResult><Upload><Key>dir/a.txt</Key><UploadId>upload1</UploadId>"+
+				"<Initiated>2017-01-02T15:04:05.000Z</Initiated></Upload></ListMultipartUploadsResult>")
+		case r.Method == "GET" && q.Get("uploadId") == "upload1":
+			fmt.Fprint(w, "<ListPartsResult>"+
+				`<Part><PartNumber>1</PartNumber><ETag>"etag1"</ETag><Size>16777216</Size></Part>`+
+				`<Part><PartNumber>2</PartNumber><ETag>"etag2"</ETag><Size>100</Size></Part>`+
+				"</ListPartsResult>")
+		case r.Method == "POST" && q.Get("uploadId") == "upload1":
+			var req struct {
+				Parts []struct {
+					PartNumber int
+					ETag       string
+				} `xml:"Part"`
+			}
+
+			if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+
+			for _, p := range req.Parts {
+				completed = append(completed, fmt.Sprintf("%d %s", p.PartNumber, p.ETag))
+			}
+
+			fmt.Fprint(w, "<CompleteMultipartUploadResult><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>")
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer cleanup()
+
+	upload, parts, err := pendingUpload(store, "dir/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upload == nil || upload.ID != "upload1" || upload.Initiated.Year() != 2017 || partsSize(parts) != 16777316 {
+		t.Errorf("unexpected upload %v with parts %v", upload, parts)
+	}
+
+	etag, err := store.CompleteUpload("dir/a.txt", "upload1", parts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(completed, []string{`1 "etag1"`, `2 "etag2"`}) || etag != "etag" {
+		t.Errorf("unexpected completed parts %v with ETag %s", completed, etag)
+	}
+
+	partETag = "552e21cd4cd9918678e3c1a0df491bc3"
+	etag, err = store.UploadPart("dir/a.txt", "upload1", 3, strings.NewReader("some text"))
+	if err != nil || etag != partETag {
+		t.Errorf("unexpected part ETag %s: %v", etag, err)
+	}
+
+	if _, err = store.UploadPart("dir/a.txt", "upload1", 3, strings.NewReader("some test")); err == nil ||
+		!strings.Contains(err.Error(), "Checksum mismatch") {
+		t.Errorf("expected a checksum mismatch, got: %v", err)
+	}
+}
+
+// uploads are sent with their metadata, and the MD5 of each request for S3 to check
+func TestS3StorePutChecksum(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	var corrupt bool
+
+	store, cleanup := newTestS3Store(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		q := r.URL.Query()
+		_, uploads := q["uploads"]
+
+		switch {
+		case r.Method == "POST" && uploads:
+			requests = append(requests, "create md5="+r.Header.Get("X-Amz-Meta-Md5"))
+			fmt.Fprint(w, "<InitiateMultipartUploadResult><UploadId>upload1</UploadId></InitiateMultipartUploadResult>")
+		case r.Method == "POST":
+			requests = append(requests, "complete")
+			fmt.Fprint(w, "<CompleteMultipartUploadResult><ETag>\"etag\"</ETag></CompleteMultipartUploadResult>")
+		case r.Method == "DELETE":
+			requests = append(requests, "abort")
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == "PUT":
+			b, _ := ioutil.ReadAll(r.Body)
+			if corrupt {
+				b = append(b, '!')
+			}
+
+			sum := md5.Sum(b)
+			if r.Header.Get("Content-MD5") != base64.StdEncoding.EncodeToString(sum[:]) {
+				w.WriteHeader(http.StatusBadRequest)
+				fmt.Fprint(w, "<Error><Code>BadDigest</Code><Message>The Content-MD5 you specified did not match what we received.</Message></Error>")
+				return
+			}
+
+			if q.Get("partNumber") != "" {
+				requests = append(requests, "part "+q.Get("partNumber"))
+				w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:])+`"`)
+				return
+			}
+
+			requests = append(requests, "put md5="+r.Header.Get("X-Amz-Meta-Md5"))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer cleanup()
+
+	metadata := map[string]string{checksumMD5: "552e21cd4cd9918678e3c1a0df491bc3"}
+	if err := store.PutWithMetadata("a.txt", strings.NewReader("some text"), metadata); err != nil {
+		t.Error(err)
+	}
+
+	// large uploads are sent in parts
+	big := strings.Repeat("x", int(store.uploader.PartSize)+1)
+	if err := store.PutWithMetadata("big.txt", strings.NewReader(big), metadata); err != nil {
+		t.Error(err)
+	}
+
+	sort.Strings(requests[2:4])
+	expected := []string{"put md5=552e21cd4cd9918678e3c1a0df491bc3", "create md5=552e21cd4cd9918678e3c1a0df491bc3",
+		"part 1", "part 2", "complete"}
+	if !reflect.DeepEqual(requests, expected) {
+		t.Errorf("expected requests %v got %v", expected, requests)
+	}
+
+	// S3 rejects data that doesn't match its MD5
+	mu.Lock()
+	corrupt = true
+	mu.Unlock()
+
+	if err := store.Put("a.txt", strings.NewReader("some text")); err == nil || !strings.Contains(err.Error(), "BadDigest") {
+		t.Errorf("expected a bad digest error, got: %v", err)
+	}
+}
@@ -8,7 +8,8 @@ import (
 	"gopkg.in/inconshreveable/log15.v2"
 	"io"
 	"io/ioutil"
-	"os"
+	"net"
+	"net/textproto"
 	"strings"
 	"testing"
 	"time"
@@ -24,6 +25,24 @@ func init() {
 	// Use a uuid based on MAC address (should be unique in Travis/Docker)
 	U = uuid.NewV1().String()
 
+	// the tests run against an in-memory object store unless STORAGE_BACKEND is set (eg: to s3 with the rest of the
+	// variables in env.list), so they don't need an S3 bucket or AWS credentials by default
+	if STORAGE_BACKEND == "" {
+		STORAGE_BACKEND = "memory"
+	}
+
+	// small pages so listings, deletes and renames have to follow continuation tokens
+	memListPageSize = 2
+
+	if FTP_PORT_STR == "" {
+		FTP_PORT_STR = "2121"
+	}
+
+	if FTP_USER == "" && USERS_FILE == "" {
+		FTP_USER = "testuser"
+		FTP_PASSWD = "testpasswd"
+	}
+
 	// run the main bucketFTP server app in a goroutine
 	go main()
 
@@ -31,17 +50,17 @@ func init() {
 	time.Sleep(time.Millisecond * 50)
 }
 
-// Integration style tests for the FTP server.  This requires variables in
-// env.list to be exported (eg: FTP_PORT, etc).
+// Integration style tests for the FTP server.  To run them against S3 the
+// variables in env.list need to be exported (eg: STORAGE_BACKEND, S3_BUCKET_NAME, etc).
 
 func getClient(doLogin bool) (*ftp.ServerConn, error) {
-	c, err := ftp.DialTimeout("localhost:"+os.Getenv("FTP_PORT"), time.Second)
+	c, err := ftp.DialTimeout("localhost:"+FTP_PORT_STR, time.Second)
 	if err != nil {
 		return nil, err
 	}
 
 	if doLogin {
-		err = c.Login(os.Getenv("FTP_USER"), os.Getenv("FTP_PASSWD"))
+		err = c.Login(FTP_USER, FTP_PASSWD)
 		if err != nil {
 			return nil, err
 		}
@@ -59,7 +78,7 @@ func TestLogin(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = c.Login(os.Getenv("FTP_USER"), os.Getenv("FTP_PASSWD"))
+	err = c.Login(FTP_USER, FTP_PASSWD)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -136,6 +155,13 @@ func TestPutAndGet(t *testing.T) {
 			t.Run(fmt.Sprintf("putting %s, expecting %v", tc.path, tc.errExpected), func(t *testing.T) {
 				driver.rootPrefix = prefix
 
+				// the root prefix is fixed when a session logs in
+				c, err := getClient(true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Quit()
+
 				if err = checkUploadedFile(c, tc.path); (err != nil) != tc.errExpected {
 					t.Error(err)
 				}
@@ -197,6 +223,13 @@ func TestDirs(t *testing.T) {
 			t.Run(fmt.Sprintf("%s:%v", tc.path, tc.errExpected), func(t *testing.T) {
 				driver.rootPrefix = prefix
 
+				// the root prefix is fixed when a session logs in
+				c, err := getClient(true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Quit()
+
 				if err = c.MakeDir(tc.path); (err != nil) != tc.errExpected {
 					t.Fatal(err)
 				}
@@ -297,6 +330,13 @@ func TestRename(t *testing.T) {
 
 				driver.rootPrefix = prefix
 
+				// the root prefix is fixed when a session logs in
+				c, err := getClient(true)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Quit()
+
 				// create any dirs required
 				if err = mkDirs(c, tc.mkDirs); err != nil {
 					t.Error(err)
@@ -517,11 +557,21 @@ func TestListFiles(t *testing.T) {
 		t.Error(err)
 	}
 
-	// Arg, this ftp client doesn't list directories.  At least we know the listing isn't recursive.
+	// the client lists with MLSD (the server announces MLST) which includes the directories, they're listed first.  The
+	// deep directory shows the listing isn't recursive.
+	expected := append([]string{dirs[0], dirs[1]}, files...)
+	if len(entries) != len(expected) {
+		t.Fatalf("Expected %d entries but observed %d", len(expected), len(entries))
+	}
+
 	for i, e := range entries {
 		name := strings.TrimSpace(e.Name)
-		if name != files[i] {
-			t.Errorf("Expected file name '%s' but observed '%s'", name, files[i])
+		if name != expected[i] {
+			t.Errorf("Expected file name '%s' but observed '%s'", expected[i], name)
+		}
+
+		if isDir := e.Type == ftp.EntryTypeFolder; isDir != (i < 2) {
+			t.Errorf("Expected %s to be a directory: %t", name, i < 2)
 		}
 	}
 
@@ -563,3 +613,387 @@ func rmDirs(c *ftp.ServerConn, dirs []string) error {
 
 	return nil
 }
+
+// REST before RETR resumes a download from the offset
+func TestResumeDownload(t *testing.T) {
+	var err error
+	var c *ftp.ServerConn
+	if c, err = getClient(true); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Quit()
+
+	path := "/resume" + U + ".txt"
+	testString := "some text in a file like object"
+
+	if err = c.Stor(path, bytes.NewBufferString(testString)); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Delete(path)
+
+	for _, offset := range []int{0, 10, len(testString)} {
+		reader, err := c.RetrFrom(path, uint64(offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		dataRead, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(dataRead) != testString[offset:] {
+			t.Errorf("expected [%s] from offset %d but saw [%s]", testString[offset:], offset, string(dataRead))
+		}
+	}
+}
+
+// SIZE reports how much of an interrupted upload was received and REST before STOR continues it
+func TestResumeUpload(t *testing.T) {
+	mp, ok := driver.store.(MultipartStore)
+	if !ok {
+		t.Skip("the storage backend doesn't support resumable uploads")
+	}
+
+	driver.uploads = mp
+	defer func() { driver.uploads = nil }()
+
+	var err error
+	var c *ftp.ServerConn
+	if c, err = getClient(true); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Quit()
+
+	path := "/resume-upload" + U + ".txt"
+	testString := "some text in a file like object"
+
+	// the start of an upload that was interrupted
+	id, err := mp.CreateUpload(driver.rootPrefix + path[1:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = mp.UploadPart(driver.rootPrefix+path[1:], id, 1, strings.NewReader(testString[:10])); err != nil {
+		t.Fatal(err)
+	}
+
+	size, err := c.FileSize(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if size != 10 {
+		t.Errorf("expected 10 bytes to have been received, saw %d", size)
+	}
+
+	if err = c.StorFrom(path, strings.NewReader(testString[size:]), uint64(size)); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Delete(path)
+
+	reader, err := c.Retr(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	dataRead, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(dataRead) != testString {
+		t.Errorf("expected [%s] but saw [%s]", testString, string(dataRead))
+	}
+}
+
+// getTextClient logs in with a plain control connection, for commands the ftp client doesn't have
+func getTextClient() (*textproto.Conn, error) {
+	c, err := textproto.Dial("tcp", "localhost:"+FTP_PORT_STR)
+	if err != nil {
+		return nil, err
+	}
+
+	steps := []struct {
+		cmd  string
+		code int
+	}{
+		{"", 220},
+		{"USER " + FTP_USER, 331},
+		{"PASS " + FTP_PASSWD, 230},
+	}
+
+	for _, s := range steps {
+		if s.cmd != "" {
+			if err = c.PrintfLine("%s", s.cmd); err != nil {
+				break
+			}
+		}
+
+		if _, _, err = c.ReadResponse(s.code); err != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// HASH and the XMD5, etc commands return the checksum of a file
+func TestHash(t *testing.T) {
+	var err error
+	var c *ftp.ServerConn
+	if c, err = getClient(true); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Quit()
+
+	path := "/hash" + U + ".txt"
+	if err = c.Stor(path, bytes.NewBufferString("some text")); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Delete(path)
+
+	var tc *textproto.Conn
+	if tc, err = getTextClient(); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+
+	testCases := []struct {
+		cmd     string
+		code    int
+		message string
+	}{
+		{"XMD5 " + path, 250, "552e21cd4cd9918678e3c1a0df491bc3"},
+		{"XSHA1 " + path, 250, "37aa63c77398d954473262e1a0057c1e632eda77"},
+		{"XSHA256 " + path, 250, "b94f6f125c79e3a5ffaa826f584c10d52ada669e6762051b826b55776d05aed2"},
+		{"XCRC " + path, 250, "4fbabdba"},
+		{"OPTS HASH", 200, "MD5"},
+		{"HASH " + path, 213, "MD5 0-9 552e21cd4cd9918678e3c1a0df491bc3 " + path},
+		{"OPTS HASH sha-256", 200, "SHA-256"},
+		{"HASH " + path, 213, "SHA-256 0-9 b94f6f125c79e3a5ffaa826f584c10d52ada669e6762051b826b55776d05aed2 " + path},
+		{"OPTS HASH SHA-512", 501, ""},
+		{"HASH /", 550, ""},
+		{"XMD5 /missing" + U + ".txt", 550, ""},
+	}
+
+	for _, test := range testCases {
+		if err = tc.PrintfLine("%s", test.cmd); err != nil {
+			t.Fatal(err)
+		}
+
+		code, message, err := tc.ReadResponse(0)
+		if err != nil && code == 0 {
+			t.Fatal(err)
+		}
+
+		if code != test.code || (test.message != "" && message != test.message) {
+			t.Errorf("%s: expected %d %s got %d %s", test.cmd, test.code, test.message, code, message)
+		}
+	}
+
+	if err = tc.PrintfLine("FEAT"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, message, err := tc.ReadResponse(211)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, feature := range []string{"HASH MD5;SHA-1;SHA-256*;CRC32", "XMD5", "XSHA1", "XSHA256", "XCRC"} {
+		if !strings.Contains(message, "\n "+feature+"\n") {
+			t.Errorf("expected FEAT to list %s: %s", feature, message)
+		}
+	}
+}
+
+// a download that fails its checksum is replied to with 451 and no 226, so the replies to later commands stay in step
+func TestChecksumMismatch(t *testing.T) {
+	store, ok := driver.store.(MetadataStore)
+	if !ok {
+		t.Skip("the storage backend doesn't store metadata")
+	}
+
+	path := "/mismatch" + U + ".txt"
+	key, err := driver.getS3Key(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.PutWithMetadata(key, bytes.NewBufferString("some text"),
+		map[string]string{checksumMD5: "00000000000000000000000000000000"}); err != nil {
+		t.Fatal(err)
+	}
+	defer driver.store.Delete([]string{key})
+
+	var tc *textproto.Conn
+	if tc, err = getTextClient(); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+
+	if err = tc.PrintfLine("PASV"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, message, err := tc.ReadResponse(227)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var h1, h2, h3, h4, p1, p2 int
+	if _, err = fmt.Sscanf(message[strings.Index(message, "(")+1:], "%d,%d,%d,%d,%d,%d", &h1, &h2, &h3, &h4, &p1,
+		&p2); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := net.Dial("tcp", fmt.Sprintf("%d.%d.%d.%d:%d", h1, h2, h3, h4, p1<<8+p2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer data.Close()
+
+	if err = tc.PrintfLine("RETR %s", path); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = tc.ReadResponse(150); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = ioutil.ReadAll(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, message, err = tc.ReadResponse(451); err != nil {
+		t.Errorf("expected 451 for the checksum mismatch: %v", err)
+	} else if !strings.Contains(message, "Checksum mismatch") {
+		t.Errorf("expected a checksum mismatch: %s", message)
+	}
+
+	if err = tc.PrintfLine("NOOP"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err = tc.ReadResponse(200); err != nil {
+		t.Errorf("expected the reply to NOOP after the failed download: %v", err)
+	}
+}
+
+// MLST gives the facts of a file or directory on the control connection, MLSD is tested by listing with the ftp client
+func TestMLST(t *testing.T) {
+	var err error
+	var c *ftp.ServerConn
+	if c, err = getClient(true); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Quit()
+
+	dir := "/mlst" + U
+	path := dir + "/file.txt"
+
+	if err = c.MakeDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer c.Delete(dir)
+
+	if err = c.Stor(path, bytes.NewBufferString("some text")); err != nil {
+		t.Fatal(err)
+	}
+
+	// MLSD only lists directories
+	if _, err = c.List(path); err == nil {
+		t.Error("expected an error listing a file with MLSD")
+	}
+
+	var tc *textproto.Conn
+	if tc, err = getTextClient(); err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Close()
+
+	testCases := []struct {
+		cmd     string
+		code    int
+		message string
+	}{
+		{"MLST " + path, 250, "type=file;size=9;modify=20????????????;perm=adfrw;unique=*; " + path},
+		{"MLST " + dir, 250, "type=dir;modify=20????????????;perm=cdeflmp;unique=*; " + dir},
+		{"MLST /missing" + U, 550, ""},
+		{"MLST", 250, "type=dir;perm=cdeflmp;unique=*; /"},
+		{"MLST /", 250, "type=dir;perm=cdeflmp;unique=*; /"},
+		{"OPTS MLST Type;size;bad;", 200, "MLST OPTS type;size;"},
+		{"MLST " + path, 250, "type=file;size=9; " + path},
+		{"OPTS MLST", 200, "MLST OPTS"},
+		{"MLST " + path, 250, " " + path},
+	}
+
+	for _, test := range testCases {
+		if err = tc.PrintfLine("%s", test.cmd); err != nil {
+			t.Fatal(err)
+		}
+
+		code, message, err := tc.ReadResponse(0)
+		if err != nil && code == 0 {
+			t.Fatal(err)
+		}
+
+		// the facts are on the second line of the reply
+		if lines := strings.Split(message, "\n"); code == 250 && len(lines) == 3 {
+			message = strings.TrimPrefix(lines[1], " ")
+		}
+
+		if code != test.code {
+			t.Errorf("%s: expected %d got %d %s", test.cmd, test.code, code, message)
+		}
+
+		if test.message != "" && !matchFacts(test.message, message) {
+			t.Errorf("%s: expected %s got %s", test.cmd, test.message, message)
+		}
+	}
+
+	if err = tc.PrintfLine("FEAT"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, message, err := tc.ReadResponse(211)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(message, "\n MLST type;size;modify;perm;unique;\n") {
+		t.Errorf("expected FEAT to list MLST without any facts selected: %s", message)
+	}
+}
+
+// matchFacts matches a line of facts against a pattern where ? is any character and * is any characters up to the next ;
+func matchFacts(pattern, facts string) bool {
+	for pattern != "" {
+		switch {
+		case pattern[0] == '*':
+			i := strings.Index(facts, ";")
+			if i < 0 {
+				return false
+			}
+			facts = facts[i:]
+		case facts == "":
+			return false
+		case pattern[0] != '?' && pattern[0] != facts[0]:
+			return false
+		default:
+			facts = facts[1:]
+		}
+
+		pattern = pattern[1:]
+	}
+
+	return facts == ""
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// certStore holds the server certificate used for FTPS.  The certificate is served with a GetCertificate callback so
+// it can be reloaded from disk (on SIGHUP or when the files change) without a restart.  New connections get the
+// reloaded certificate while existing sessions carry on with the one they negotiated.
+type certStore struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time // latest modification time of the cert and key files when they were loaded
+}
+
+func newCertStore(certFile, keyFile string) (*certStore, error) {
+	c := &certStore{certFile: certFile, keyFile: keyFile}
+
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Reload re-reads the certificate and key.  The current certificate is kept if they cannot be loaded.
+func (c *certStore) Reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("Error loading TLS certificate %s and key %s: %s", c.certFile, c.keyFile, err)
+	}
+
+	c.mu.Lock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.mu.Unlock()
+
+	log.Printf("loaded TLS certificate %s", c.certFile)
+
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (c *certStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.cert, nil
+}
+
+// reloadIfChanged reloads the certificate if the cert or key file has been modified since it was loaded
+func (c *certStore) reloadIfChanged() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	c.mu.RLock()
+	changed := !modTime.Equal(c.modTime)
+	c.mu.RUnlock()
+
+	if !changed {
+		return nil
+	}
+
+	return c.Reload()
+}
+
+// watch polls the cert and key files for changes.  It never returns.
+func (c *certStore) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		if err := c.reloadIfChanged(); err != nil {
+			log.Println("error reloading TLS certificate", err)
+		}
+	}
+}
+
+func (c *certStore) filesModTime() (time.Time, error) {
+	var modTime time.Time
+
+	for _, f := range []string{c.certFile, c.keyFile} {
+		fi, err := os.Stat(f)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Error loading TLS certificate: %s", err)
+		}
+
+		if fi.ModTime().After(modTime) {
+			modTime = fi.ModTime()
+		}
+	}
+
+	return modTime, nil
+}
+
+// loadCertPool reads the PEM encoded CA certificates used to verify TLS client certificates
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("Error loading TLS client CA file: %s", err)
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("Error loading TLS client CA file %s: no PEM certificates found", caFile)
+	}
+
+	return pool, nil
+}
+
+// newTLSConfig returns the TLS config used for explicit FTPS (AUTH TLS) on both the control and data connections.
+// If clientCAs isn't nil clients may present a certificate signed by one of them, which AuthUser maps to a user.
+func newTLSConfig(certs *certStore, clientCAs *x509.CertPool) *tls.Config {
+	config := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+
+	if clientCAs != nil {
+		config.ClientCAs = clientCAs
+		// certificates are optional, users without client cert names can still log in with a password
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	return config
+}
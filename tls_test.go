@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeTestCert writes a self signed certificate and key for commonName to dir, returning their paths
+func writeTestCert(t *testing.T, dir, commonName string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		DNSNames:              []string{commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+
+	var der []byte
+	if der, err = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key); err != nil {
+		t.Fatal(err)
+	}
+
+	var keyDer []byte
+	if keyDer, err = x509.MarshalECPrivateKey(key); err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, commonName+".crt")
+	keyFile := filepath.Join(dir, commonName+".key")
+
+	if err = ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestCertStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucketftp-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "ftp.example.com")
+
+	d := &S3Driver{}
+	if _, err = d.GetTLSConfig(); err == nil {
+		t.Error("expected an error getting the TLS config when TLS isn't configured")
+	}
+
+	var certs *certStore
+	if certs, err = newCertStore(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	d.tlsConfig = newTLSConfig(certs, nil)
+
+	var config *tls.Config
+	if config, err = d.GetTLSConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkCommonName := func(expected string) {
+		cert, err := config.GetCertificate(&tls.ClientHelloInfo{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var leaf *x509.Certificate
+		if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			t.Fatal(err)
+		}
+
+		if leaf.Subject.CommonName != expected {
+			t.Errorf("expected certificate for %s but got %s", expected, leaf.Subject.CommonName)
+		}
+	}
+
+	checkCommonName("ftp.example.com")
+
+	// unchanged files aren't reloaded
+	if err = certs.reloadIfChanged(); err != nil {
+		t.Error(err)
+	}
+
+	// rotate the certificate, making sure the modification time changes
+	newCertFile, newKeyFile := writeTestCert(t, dir, "ftp2.example.com")
+	for _, f := range [][]string{{newCertFile, certFile}, {newKeyFile, keyFile}} {
+		if err = os.Rename(f[0], f[1]); err != nil {
+			t.Fatal(err)
+		}
+
+		future := time.Now().Add(time.Minute)
+		if err = os.Chtimes(f[1], future, future); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = certs.reloadIfChanged(); err != nil {
+		t.Error(err)
+	}
+
+	checkCommonName("ftp2.example.com")
+
+	// a broken key is an error and the current certificate is kept
+	if err = ioutil.WriteFile(keyFile, []byte("not a key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = certs.Reload(); err == nil {
+		t.Error("expected an error reloading an invalid key")
+	}
+
+	checkCommonName("ftp2.example.com")
+
+	if _, err = newCertStore(filepath.Join(dir, "missing.crt"), keyFile); err == nil {
+		t.Error("expected an error loading a missing TLS cert")
+	}
+}
+
+// clientCertState does a TLS handshake with the server config using the client certificate (if any) and returns the
+// server side connection state
+func clientCertState(t *testing.T, serverConfig *tls.Config, certFile, keyFile string) *tls.ConnectionState {
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	serverConn, clientConn := net.Pipe()
+	defer serverConn.Close()
+	defer clientConn.Close()
+
+	client := tls.Client(clientConn, clientConfig)
+	go client.Handshake()
+
+	server := tls.Server(serverConn, serverConfig)
+	if err := server.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+
+	state := server.ConnectionState()
+	return &state
+}
+
+func TestClientCertAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucketftp-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	certFile, keyFile := writeTestCert(t, dir, "ftp.example.com")
+	ingestCert, ingestKey := writeTestCert(t, dir, "ingest01.example.com")
+	otherCert, otherKey := writeTestCert(t, dir, "ingest02.example.com")
+
+	var certs *certStore
+	if certs, err = newCertStore(certFile, keyFile); err != nil {
+		t.Fatal(err)
+	}
+
+	// only the certificates in the CA file are trusted
+	var clientCAs *x509.CertPool
+	if clientCAs, err = loadCertPool(ingestCert); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = loadCertPool(keyFile); err == nil {
+		t.Error("expected an error loading a CA file without certificates")
+	}
+
+	config := newTLSConfig(certs, clientCAs)
+
+	users, err := NewUserStore(
+		&User{Name: "ingest", ClientCertNames: []string{"ingest01.example.com"}},
+		&User{Name: "ingest2fa", Password: "secret1", ClientCertNames: []string{"INGEST01.example.com"}, ClientCertRequirePassword: true},
+		&User{Name: "legacy", Password: "secret2"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	withCert := clientCertState(t, config, ingestCert, ingestKey)
+	withoutCert := clientCertState(t, config, "", "")
+
+	testCases := []struct {
+		user, passwd string
+		state        *tls.ConnectionState
+		errExpected  bool
+	}{
+		{"ingest", "", withCert, false},
+		{"ingest", "anything", withCert, false},
+		{"ingest", "", withoutCert, true},
+		{"ingest", "", nil, true},
+		{"ingest2fa", "secret1", withCert, false},
+		{"ingest2fa", "wrong", withCert, true},
+		{"ingest2fa", "secret1", withoutCert, true},
+		{"legacy", "secret2", withCert, false},
+		{"legacy", "secret2", withoutCert, false},
+		{"legacy", "", withCert, true},
+	}
+
+	d := &S3Driver{users: users}
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s, %s, %t", tc.user, tc.passwd, tc.errExpected), func(t *testing.T) {
+			cc := &testContext{controlTLS: tc.state != nil, tlsState: tc.state}
+			if _, err := d.AuthUser(cc, tc.user, tc.passwd); (err != nil) != tc.errExpected {
+				t.Errorf("unexpected result logging in as %s: %v", tc.user, err)
+			}
+		})
+	}
+
+	// a certificate that isn't signed by a client CA isn't accepted
+	untrusted := clientCertState(t, config, otherCert, otherKey)
+	if _, err = d.AuthUser(&testContext{controlTLS: true, tlsState: untrusted}, "ingest", ""); err == nil {
+		t.Error("expected an untrusted client certificate to be rejected")
+	}
+}
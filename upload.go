@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// uploadPartSize is the size of the parts resumable uploads are sent in.  An interrupted upload keeps the complete
+// parts, so up to this much is sent again when it's resumed.  S3 allows parts of 5MB to 5GB and up to 10000 parts, so
+// this limits resumable uploads to 160GB.
+var uploadPartSize = 16 * 1024 * 1024
+
+const (
+	// the smallest object appended to by copying it into a multipart upload (S3's minimum part size).  Smaller objects
+	// are read and uploaded again with the new data.
+	appendCopyMinSize = 5 * 1024 * 1024
+	// the largest part that can be copied from an object
+	maxCopyPartSize = 5 * 1024 * 1024 * 1024
+)
+
+// uploadParts uploads body to a multipart upload in parts of uploadPartSize, after the parts already uploaded, and
+// completes the upload at the end of body.  If reading body fails (the transfer was interrupted) the partial part is
+// dropped and the upload is left to be resumed.
+//
+// The MD5 of each part is worked out as body is read and the object is checked against the ETag they give when it's
+// completed (the parts already uploaded are checked against the ETags they were given).  That checks the whole file
+// arrived intact, but there's no checksum of the whole file to store with it.
+func uploadParts(uploads MultipartStore, key, uploadID string, parts []Part, body io.Reader) error {
+	buf := make([]byte, uploadPartSize)
+	sums, checked := partSums(parts)
+
+	upload := func(data []byte) (err error) {
+		sum := md5.Sum(data)
+		sums = append(sums, sum[:]...)
+
+		parts, err = uploadPart(uploads, key, uploadID, parts, data)
+		return err
+	}
+
+	for {
+		n, err := io.ReadFull(body, buf)
+
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			// the last part can be smaller, an empty file needs an empty part
+			if n > 0 || len(parts) == 0 {
+				if err = upload(buf[:n]); err != nil {
+					return err
+				}
+			}
+
+			var expected string
+			if checked {
+				expected = multipartETag(sums)
+			}
+
+			return completeUpload(uploads, key, uploadID, parts, expected)
+		default:
+			return err
+		}
+
+		if err = upload(buf); err != nil {
+			return err
+		}
+	}
+}
+
+// uploadPart uploads data as the part after parts and returns parts with it added
+func uploadPart(uploads MultipartStore, key, uploadID string, parts []Part, data []byte) ([]Part, error) {
+	part := Part{Number: 1, Size: int64(len(data))}
+	if len(parts) > 0 {
+		part.Number = parts[len(parts)-1].Number + 1
+	}
+
+	var err error
+	if part.ETag, err = uploads.UploadPart(key, uploadID, part.Number, bytes.NewReader(data)); err != nil {
+		return nil, err
+	}
+
+	return append(parts, part), nil
+}
+
+// completeUpload completes the upload from parts and checks the object's ETag is the expected one, if there is one.
+// The object has been created by then, but a mismatch is returned as an error so the client knows to upload the file
+// again.
+func completeUpload(uploads MultipartStore, key, uploadID string, parts []Part, expected string) error {
+	etag, err := uploads.CompleteUpload(key, uploadID, parts)
+	if err != nil {
+		return err
+	}
+
+	if etag != "" && expected != "" && !strings.EqualFold(etag, expected) {
+		return fmt.Errorf("Checksum mismatch uploading %s: the ETag is %s but the data sent gives %s", key, etag,
+			expected)
+	}
+
+	return nil
+}
+
+// partSums returns the MD5s of the parts one after another from their ETags, false if their ETags aren't MD5s
+func partSums(parts []Part) ([]byte, bool) {
+	var sums []byte
+	for _, p := range parts {
+		if !isMD5ETag(p.ETag) {
+			return nil, false
+		}
+
+		sum, _ := hex.DecodeString(p.ETag)
+		sums = append(sums, sum...)
+	}
+
+	return sums, true
+}
+
+// partsETag returns the ETag of an object made from parts, or "" if their ETags aren't MD5s
+func partsETag(parts []Part) string {
+	sums, ok := partSums(parts)
+	if !ok {
+		return ""
+	}
+
+	return multipartETag(sums)
+}
+
+// multipartUpload uploads body to key with a new multipart upload (see uploadParts).  The upload is aborted if it
+// fails so the object is left as it was.
+func multipartUpload(uploads MultipartStore, key string, body io.Reader) error {
+	uploadID, err := uploads.CreateUpload(key)
+	if err != nil {
+		return err
+	}
+
+	return uploadOrAbort(uploads, key, uploadID, nil, body)
+}
+
+// uploadOrAbort uploads body to the upload after parts with uploadParts, aborting the upload if it fails
+func uploadOrAbort(uploads MultipartStore, key, uploadID string, parts []Part, body io.Reader) error {
+	err := uploadParts(uploads, key, uploadID, parts, body)
+	if err == nil {
+		return nil
+	}
+
+	if abortErr := uploads.AbortUpload(key, uploadID); abortErr != nil {
+		log.Printf("error aborting upload to %s: %s", key, abortErr)
+	}
+
+	return err
+}
+
+// appendUpload replaces the object key, which is size bytes, with the object followed by body.  The object is copied
+// into a multipart upload without reading it so it must be at least appendCopyMinSize, and there's no checksum of the
+// whole file to store (see uploadParts).  The upload is aborted if it fails so the object is left as it was.
+func appendUpload(uploads MultipartStore, key string, size int64, body io.Reader) error {
+	uploadID, err := uploads.CreateUpload(key)
+	if err != nil {
+		return err
+	}
+
+	// equal parts, so none are too small
+	count := (size + maxCopyPartSize - 1) / maxCopyPartSize
+	partSize := (size + count - 1) / count
+	var parts []Part
+
+	for offset := int64(0); offset < size && err == nil; offset += partSize {
+		if offset+partSize > size {
+			partSize = size - offset
+		}
+
+		part := Part{Number: len(parts) + 1, Size: partSize}
+		part.ETag, err = uploads.CopyPart(key, uploadID, part.Number, key, offset, partSize)
+		parts = append(parts, part)
+	}
+
+	if err != nil {
+		if abortErr := uploads.AbortUpload(key, uploadID); abortErr != nil {
+			log.Printf("error aborting append to %s: %s", key, abortErr)
+		}
+
+		return err
+	}
+
+	return uploadOrAbort(uploads, key, uploadID, parts, body)
+}
+
+// pendingUpload returns the most recent upload to key that hasn't been completed or aborted and its parts.  The upload
+// is nil if there isn't one.
+func pendingUpload(uploads MultipartStore, key string) (*Upload, []Part, error) {
+	list, err := uploads.Uploads(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var latest *Upload
+	for i := range list {
+		// the prefix also matches longer keys
+		if list[i].Key == key && (latest == nil || list[i].Initiated.After(latest.Initiated)) {
+			latest = &list[i]
+		}
+	}
+
+	if latest == nil {
+		return nil, nil, nil
+	}
+
+	parts, err := uploads.Parts(key, latest.ID)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return latest, parts, nil
+}
+
+// partsSize returns the number of bytes in the parts
+func partsSize(parts []Part) int64 {
+	var size int64
+	for _, p := range parts {
+		size += p.Size
+	}
+
+	return size
+}
+
+// abortUploads aborts the uploads to key that haven't been completed
+func abortUploads(uploads MultipartStore, key string) error {
+	list, err := uploads.Uploads(key)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range list {
+		if u.Key != key {
+			continue
+		}
+
+		if err = uploads.AbortUpload(u.Key, u.ID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// abortStaleUploads aborts the uploads below prefix that were started more than maxAge ago.  It returns the number of
+// uploads aborted.
+func abortStaleUploads(uploads MultipartStore, prefix string, maxAge time.Duration) (int, error) {
+	list, err := uploads.Uploads(prefix)
+	if err != nil {
+		return 0, err
+	}
+
+	aborted := 0
+	cutoff := time.Now().Add(-maxAge)
+
+	for _, u := range list {
+		if !u.Initiated.Before(cutoff) {
+			continue
+		}
+
+		if err = uploads.AbortUpload(u.Key, u.ID); err != nil {
+			return aborted, err
+		}
+		aborted++
+	}
+
+	return aborted, nil
+}
+
+// watchUploads aborts stale uploads every interval, until the server stops
+func watchUploads(uploads MultipartStore, prefix string, maxAge, interval time.Duration) {
+	for range time.Tick(interval) {
+		n, err := abortStaleUploads(uploads, prefix, maxAge)
+		if err != nil {
+			log.Println("error aborting stale uploads", err)
+		}
+
+		if n > 0 {
+			log.Printf("aborted %d uploads started more than %s ago", n, maxAge)
+		}
+	}
+}
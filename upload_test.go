@@ -0,0 +1,498 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// an interrupted upload keeps the complete parts and can be continued from the end of them
+func TestResumableUpload(t *testing.T) {
+	defer func(size int) { uploadPartSize = size }(uploadPartSize)
+	uploadPartSize = 10
+
+	store := NewMemStore()
+	const data = "0123456789abcdefghijklmnopqrstuvwxyz"
+
+	f, err := NewS3VirtualFile("dir/a.txt", os.O_WRONLY, store, store, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write([]byte(data[:25])); err != nil {
+		t.Fatal(err)
+	}
+
+	f.Abort(errors.New("connection reset"))
+
+	upload, parts, err := pendingUpload(store, "dir/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the last 5 bytes weren't a complete part so they're dropped
+	if upload == nil || partsSize(parts) != 20 {
+		t.Fatalf("expected an upload with 20 bytes, got %v %v", upload, parts)
+	}
+
+	if _, err = store.Head("dir/a.txt"); err == nil {
+		t.Error("expected the interrupted upload not to create the object")
+	}
+
+	// SIZE reports where to resume from, files that already exist report their own size
+	d := &S3Driver{store: store, uploads: store}
+	if err = store.Put("dir/b.txt", strings.NewReader("some text")); err != nil {
+		t.Fatal(err)
+	}
+
+	uploadID, err := store.CreateUpload("dir/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, size := range map[string]int64{"/dir/a.txt": 20, "/dir/b.txt": 9} {
+		if info, err := d.GetFileInfo(nil, path); err != nil || info.Size() != size {
+			t.Errorf("%s: expected size %d: %v %v", path, size, info, err)
+		}
+	}
+
+	if err = store.AbortUpload("dir/b.txt", uploadID); err != nil {
+		t.Fatal(err)
+	}
+
+	// resuming from anywhere else fails
+	if f, err = NewS3VirtualFile("dir/a.txt", os.O_WRONLY, store, store, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Seek(25, 0); err == nil {
+		t.Error("expected an error resuming from the wrong offset")
+	}
+
+	if f, err = NewS3VirtualFile("dir/a.txt", os.O_WRONLY, store, store, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Seek(20, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = f.Write([]byte(data[20:])); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	body, info, err := store.Get("dir/a.txt", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := ioutil.ReadAll(body)
+	body.Close()
+
+	if string(b) != data {
+		t.Errorf("expected %q got %q", data, b)
+	}
+
+	// like S3 the ETag of a multipart upload is the MD5 of the parts' MD5s
+	if info.ETag != "609cae51544cc83f099854e687c3fbca-4" {
+		t.Errorf("unexpected multipart ETag %s", info.ETag)
+	}
+
+	if uploads, _ := store.Uploads(""); len(uploads) != 0 {
+		t.Errorf("expected the upload to be completed, found %v", uploads)
+	}
+
+	// an empty file is still written and starting again replaces an interrupted upload
+	if _, err = store.CreateUpload("dir/empty.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	if f, err = NewS3VirtualFile("dir/empty.txt", os.O_WRONLY, store, store, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := store.Head("dir/empty.txt"); err != nil || info.Size != 0 {
+		t.Errorf("expected an empty file: %v", err)
+	}
+
+	if uploads, _ := store.Uploads(""); len(uploads) != 0 {
+		t.Errorf("expected the interrupted upload to be aborted, found %v", uploads)
+	}
+}
+
+// APPE keeps the existing contents of the file, copying large objects in parts and uploading small ones again
+func TestAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucketftp-append")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFSStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := strings.Repeat("x", appendCopyMinSize+1)
+
+	testCases := []struct {
+		name     string
+		store    ObjectStore
+		existing string
+	}{
+		{"memory", NewMemStore(), "hello "},
+		{"memory large", NewMemStore(), large},
+		{"memory missing", NewMemStore(), ""},
+		{"cached memory", NewCachedStore(NewMemStore(), time.Minute, 100), "hello "},
+		{"fs", fs, "hello "},
+		{"cached fs", NewCachedStore(fs, time.Minute, 100), "hello "},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.existing != "" {
+				if err := tc.store.Put("a.txt", strings.NewReader(tc.existing)); err != nil {
+					t.Fatal(err)
+				}
+			} else {
+				tc.store.Delete([]string{"a.txt"})
+			}
+
+			// so the cached size is stale if it isn't invalidated
+			tc.store.Head("a.txt")
+
+			f, err := NewS3VirtualFile("a.txt", os.O_WRONLY|os.O_APPEND, tc.store, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = f.Write([]byte("world")); err != nil {
+				t.Fatal(err)
+			}
+
+			if err = f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			body, _, err := tc.store.Get("a.txt", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b, _ := ioutil.ReadAll(body)
+			body.Close()
+
+			if string(b) != tc.existing+"world" {
+				t.Errorf("expected %d bytes ending in world, got %d bytes", len(tc.existing)+5, len(b))
+			}
+
+			if info, err := tc.store.Head("a.txt"); err != nil || info.Size != int64(len(b)) {
+				t.Errorf("unexpected size after appending: %v", err)
+			}
+
+			if m, ok := tc.store.(MultipartStore); ok {
+				if uploads, _ := m.Uploads(""); len(uploads) != 0 {
+					t.Errorf("expected no uploads to be left, found %v", uploads)
+				}
+			}
+		})
+	}
+
+	// an interrupted append leaves the file as it was
+	store := NewMemStore()
+	if err = store.Put("a.txt", strings.NewReader("hello ")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := NewS3VirtualFile("a.txt", os.O_WRONLY|os.O_APPEND, store, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte("wor"))
+	f.Abort(errors.New("connection reset"))
+
+	if info, err := store.Head("a.txt"); err != nil || info.Size != 6 {
+		t.Errorf("expected the file to be unchanged: %v", err)
+	}
+
+	if uploads, _ := store.Uploads(""); len(uploads) != 0 {
+		t.Errorf("expected the upload to be aborted, found %v", uploads)
+	}
+}
+
+// the file is only replaced when an upload finishes, a failed upload leaves the previous version
+func TestUploadReplacesOnClose(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bucketftp-upload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, err := NewFSStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, store := range []ObjectStore{NewMemStore(), fs} {
+		if err = store.Put("a.txt", strings.NewReader("old")); err != nil {
+			t.Fatal(err)
+		}
+
+		read := func() string {
+			body, _, err := store.Get("a.txt", 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+
+			b, _ := ioutil.ReadAll(body)
+			return string(b)
+		}
+
+		f, err := NewS3VirtualFile("a.txt", os.O_WRONLY, store, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = f.Write([]byte("new")); err != nil {
+			t.Fatal(err)
+		}
+
+		if s := read(); s != "old" {
+			t.Errorf("expected the old file during the upload, saw %q", s)
+		}
+
+		f.Abort(errors.New("connection reset"))
+
+		if s := read(); s != "old" {
+			t.Errorf("expected the old file after a failed upload, saw %q", s)
+		}
+
+		if f, err = NewS3VirtualFile("a.txt", os.O_WRONLY, store, nil, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		f.Write([]byte("new"))
+
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if s := read(); s != "new" {
+			t.Errorf("expected the new file after the upload, saw %q", s)
+		}
+	}
+}
+
+// uploads store their checksums and downloads are checked against them
+func TestUploadChecksums(t *testing.T) {
+	store := NewMemStore()
+
+	f, err := NewS3VirtualFile("a.txt", os.O_WRONLY, store, nil, []string{checksumMD5, checksumSHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.Write([]byte("some text"))
+
+	if err = f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := store.Head("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if info.Metadata["md5"] != "552e21cd4cd9918678e3c1a0df491bc3" || info.Metadata["sha256"] == "" {
+		t.Errorf("unexpected checksums %v", info.Metadata)
+	}
+
+	read := func() error {
+		f, err := NewS3VirtualFile("a.txt", os.O_RDONLY, store, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		_, err = ioutil.ReadAll(f)
+		return err
+	}
+
+	if err = read(); err != nil {
+		t.Error(err)
+	}
+
+	// the object doesn't match the checksum stored with it
+	info.Metadata["sha256"] = strings.Repeat("0", 64)
+	if err = store.PutWithMetadata("a.txt", strings.NewReader("some text"), info.Metadata); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = read(); err == nil || !strings.Contains(err.Error(), "Checksum mismatch") {
+		t.Errorf("expected a checksum mismatch, got: %v", err)
+	}
+
+	// a resumed download can't be checked
+	if f, err = NewS3VirtualFile("a.txt", os.O_RDONLY, store, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err = f.Seek(5, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := ioutil.ReadAll(f); err != nil || string(b) != "text" {
+		t.Errorf("unexpected resumed download %q: %v", b, err)
+	}
+
+	// the checksums are sent with the upload so they're only worked out for files that fit in memory
+	defer func(size int) { uploadPartSize = size }(uploadPartSize)
+	uploadPartSize = 10
+
+	for _, uploads := range []MultipartStore{nil, store} {
+		for data, stored := range map[string]bool{"some text": true, "some more text": false} {
+			if f, err = NewS3VirtualFile("b.txt", os.O_WRONLY, store, uploads, []string{checksumMD5}); err != nil {
+				t.Fatal(err)
+			}
+
+			f.Write([]byte(data))
+
+			if err = f.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if info, err = store.Head("b.txt"); err != nil {
+				t.Fatal(err)
+			}
+
+			if (info.Metadata[checksumMD5] != "") != stored {
+				t.Errorf("%q resumable %t: expected checksums stored %t: %v", data, uploads != nil, stored, info.Metadata)
+			}
+		}
+	}
+
+	if uploads, _ := store.Uploads(""); len(uploads) != 0 {
+		t.Errorf("expected no uploads to be left, found %v", uploads)
+	}
+}
+
+// uploadsCountingStore is a MemStore that counts the calls to Uploads
+type uploadsCountingStore struct {
+	*MemStore
+	calls int
+}
+
+func (s *uploadsCountingStore) Uploads(prefix string) ([]Upload, error) {
+	s.calls++
+	return s.MemStore.Uploads(prefix)
+}
+
+// SIZE, MDTM and MLST of a directory don't look for uploads to it, which would list all the uploads in it
+func TestDirInfoSkipsUploads(t *testing.T) {
+	store := &uploadsCountingStore{MemStore: NewMemStore()}
+	if err := store.Put("dir/", strings.NewReader("")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := store.CreateUpload("dir/a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	d := &S3Driver{store: store, uploads: store}
+	if info, err := d.GetFileInfo(nil, "/dir"); err != nil || !info.IsDir() {
+		t.Errorf("expected a directory: %v %v", info, err)
+	}
+
+	if store.calls != 0 {
+		t.Errorf("expected no uploads to be listed for a directory, got %d calls", store.calls)
+	}
+
+	// a path that isn't a file or directory still finds its upload
+	if info, err := d.GetFileInfo(nil, "/dir/a.txt"); err != nil || info.Size() != 0 {
+		t.Errorf("expected the pending upload: %v %v", info, err)
+	}
+}
+
+// badETagStore is a MemStore that returns the wrong ETag for completed uploads
+type badETagStore struct {
+	*MemStore
+}
+
+func (s badETagStore) CompleteUpload(key, uploadID string, parts []Part) (string, error) {
+	if _, err := s.MemStore.CompleteUpload(key, uploadID, parts); err != nil {
+		return "", err
+	}
+
+	return "00000000000000000000000000000000-1", nil
+}
+
+// an upload whose object doesn't have the ETag of the parts sent fails, so the client can send it again
+func TestCompleteUploadMismatch(t *testing.T) {
+	defer func(size int) { uploadPartSize = size }(uploadPartSize)
+	uploadPartSize = 10
+
+	store := badETagStore{NewMemStore()}
+
+	// resumable or not, files larger than a part are multipart uploads
+	for _, uploads := range []MultipartStore{nil, store} {
+		f, err := NewS3VirtualFile("a.txt", os.O_WRONLY, store, uploads, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		f.Write([]byte("some more text"))
+
+		if err = f.Close(); err == nil || !strings.Contains(err.Error(), "Checksum mismatch") {
+			t.Errorf("resumable %t: expected a checksum mismatch, got: %v", uploads != nil, err)
+		}
+	}
+}
+
+func TestAbortStaleUploads(t *testing.T) {
+	store := NewMemStore()
+
+	for _, key := range []string{"home/a.txt", "home/b.txt", "other/c.txt"} {
+		if _, err := store.CreateUpload(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nothing is old enough yet
+	if n, err := abortStaleUploads(store, "home/", time.Hour); err != nil || n != 0 {
+		t.Errorf("expected no uploads to be aborted, got %d: %v", n, err)
+	}
+
+	for _, u := range store.uploads {
+		if u.key == "home/a.txt" || u.key == "other/c.txt" {
+			u.initiated = u.initiated.Add(-2 * time.Hour)
+		}
+	}
+
+	if n, err := abortStaleUploads(store, "home/", time.Hour); err != nil || n != 1 {
+		t.Errorf("expected 1 upload to be aborted, got %d: %v", n, err)
+	}
+
+	var keys []string
+	uploads, _ := store.Uploads("")
+	for _, u := range uploads {
+		keys = append(keys, u.Key)
+	}
+
+	if len(keys) != 2 || strings.Contains(strings.Join(keys, " "), "home/a.txt") {
+		t.Errorf("expected home/a.txt to be aborted, have uploads %v", keys)
+	}
+}
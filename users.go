@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path"
+	"strings"
+	"sync"
+)
+
+// errIncorrectLogin is the same for an unknown username and a wrong password so the error doesn't reveal which accounts
+// exist.  The log has the details.
+var errIncorrectLogin = errors.New("incorrect username or password")
+
+// dummyPasswordHash is checked when the username is unknown, it's a bcrypt hash (the default for new hashes) of a
+// password nobody uses
+const dummyPasswordHash = "$2a$10$t6AzGN5cz6bEWFeGlR5tbO6Z9l0rIkE/ns.MfhP.HgREziuHiCgSi"
+
+// User is a single FTP account.  PasswordHash (bcrypt or argon2id, see passwords.go) should be used in users files,
+// Password is plain text and is only intended for the single FTP_USER account.
+type User struct {
+	Name         string `json:"name"`
+	Password     string `json:"password,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+	Home         string `json:"home,omitempty"`        // S3 prefix (relative to ROOT_PREFIX) the user is jailed to, eg: sites/WGTN/
+	RequireTLS   bool   `json:"require_tls,omitempty"` // only accept a login after AUTH TLS
+
+	// ClientCertNames are the TLS client certificate names (subject common name, DNS or email SANs) mapped to this
+	// account.  If set the user must log in with a certificate, signed by TLS_CLIENT_CA_FILE, matching one of them.
+	// The password is only checked as well if ClientCertRequirePassword is set.
+	ClientCertNames           []string `json:"client_cert_names,omitempty"`
+	ClientCertRequirePassword bool     `json:"client_cert_require_password,omitempty"`
+
+	// Permissions lists the permission profiles restricting the user, eg: ["read-only"] or ["no-delete", "no-rename"].
+	// Users without any profiles have full access.
+	Permissions []string `json:"permissions,omitempty"`
+
+	perms permissions
+}
+
+// permissions restrict the operations a user can perform.  They are the union of the user's permission profiles.
+type permissions struct {
+	noRead      bool // download files
+	noWrite     bool // upload files
+	noOverwrite bool // upload over an existing file
+	noList      bool // list directories or get file info (SIZE, MDTM, etc)
+	noDelete    bool
+	noRename    bool
+	noMkdir     bool
+}
+
+var permissionProfiles = map[string]permissions{
+	"read-only": {noWrite: true, noDelete: true, noRename: true, noMkdir: true},
+	// a drop box for field devices, files can be uploaded but not read back, listed, overwritten or removed
+	"drop-box":   {noRead: true, noList: true, noOverwrite: true, noDelete: true, noRename: true},
+	"write-only": {noRead: true, noList: true, noOverwrite: true, noDelete: true, noRename: true},
+	"no-delete":  {noDelete: true},
+	"no-rename":  {noRename: true},
+}
+
+func (p permissions) union(o permissions) permissions {
+	return permissions{
+		noRead:      p.noRead || o.noRead,
+		noWrite:     p.noWrite || o.noWrite,
+		noOverwrite: p.noOverwrite || o.noOverwrite,
+		noList:      p.noList || o.noList,
+		noDelete:    p.noDelete || o.noDelete,
+		noRename:    p.noRename || o.noRename,
+		noMkdir:     p.noMkdir || o.noMkdir,
+	}
+}
+
+// usersFile is the layout of the JSON file listing the FTP accounts, eg:
+//
+//	{
+//	    "users": [
+//	        {"name": "wgtn", "password_hash": "$2a$10$...", "home": "sites/WGTN/", "permissions": ["drop-box"]},
+//	        {"name": "akld", "password_hash": "$argon2id$v=19$m=65536,t=1,p=4$..."}
+//	    ]
+//	}
+type usersFile struct {
+	Users []*User `json:"users"`
+}
+
+// UserStore holds the FTP accounts.  When loaded from a file it can be reloaded at runtime so passwords can be rotated
+// without restarting the server.
+type UserStore struct {
+	mu    sync.RWMutex
+	path  string
+	users map[string]*User
+}
+
+// NewUserStore returns a UserStore holding the given accounts.  It is not backed by a file so Reload is a no-op.
+func NewUserStore(users ...*User) (*UserStore, error) {
+	s := &UserStore{}
+
+	var err error
+	if s.users, err = indexUsers(users); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// LoadUserStore reads the accounts from a JSON users file
+func LoadUserStore(path string) (*UserStore, error) {
+	s := &UserStore{path: path}
+
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Reload re-reads the users file.  The existing accounts are kept if the file cannot be read or is invalid.
+func (s *UserStore) Reload() error {
+	if s.path == "" {
+		return nil
+	}
+
+	var err error
+	var b []byte
+	if b, err = ioutil.ReadFile(s.path); err != nil {
+		return err
+	}
+
+	var f usersFile
+	if err = json.Unmarshal(b, &f); err != nil {
+		return fmt.Errorf("Error parsing users file %s: %s", s.path, err)
+	}
+
+	var users map[string]*User
+	if users, err = indexUsers(f.Users); err != nil {
+		return fmt.Errorf("Error in users file %s: %s", s.path, err)
+	}
+
+	s.mu.Lock()
+	s.users = users
+	s.mu.Unlock()
+
+	log.Printf("loaded %d users from %s", len(users), s.path)
+
+	return nil
+}
+
+// RequiresTLS returns true if the account with the username must log in over TLS.  It doesn't need the password, so
+// the login can be refused before the password is checked.
+func (s *UserStore) RequiresTLS(name string) bool {
+	s.mu.RLock()
+	u, ok := s.users[name]
+	s.mu.RUnlock()
+
+	return ok && u.RequireTLS
+}
+
+// Authenticate returns the account matching the username and password.  cert is the verified TLS client certificate
+// presented by the client, or nil.  Accounts with client certificate names require a matching certificate.
+func (s *UserStore) Authenticate(name, pass string, cert *x509.Certificate) (*User, error) {
+	s.mu.RLock()
+	u, ok := s.users[name]
+	s.mu.RUnlock()
+
+	if !ok {
+		// check a password anyway so an unknown username takes as long as a wrong password
+		checkPasswordHash(dummyPasswordHash, pass)
+		log.Println("unknown username", name)
+		return nil, errIncorrectLogin
+	}
+
+	if len(u.ClientCertNames) > 0 {
+		if cert == nil {
+			log.Println("no client certificate for user", name)
+			return nil, errors.New("a TLS client certificate is required")
+		}
+
+		if !u.matchesCert(cert) {
+			log.Println("client certificate does not match user", name, cert.Subject.CommonName)
+			return nil, errors.New("TLS client certificate does not match user")
+		}
+
+		if !u.ClientCertRequirePassword {
+			return u, nil
+		}
+	}
+
+	if !u.checkPassword(pass) {
+		log.Println("incorrect password for user", name)
+		return nil, errIncorrectLogin
+	}
+
+	return u, nil
+}
+
+// matchesCert returns true if the certificate's subject common name, DNS names or email addresses match any of the
+// user's client certificate names
+func (u *User) matchesCert(cert *x509.Certificate) bool {
+	certNames := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	certNames = append(certNames, cert.EmailAddresses...)
+
+	for _, name := range u.ClientCertNames {
+		for _, certName := range certNames {
+			if certName != "" && strings.EqualFold(name, certName) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (u *User) checkPassword(pass string) bool {
+	if u.PasswordHash != "" {
+		return checkPasswordHash(u.PasswordHash, pass)
+	}
+
+	return checkPlainPassword(u.Password, pass)
+}
+
+func indexUsers(users []*User) (map[string]*User, error) {
+	m := make(map[string]*User, len(users))
+
+	for _, u := range users {
+		if u == nil || u.Name == "" {
+			return nil, errors.New("user with an empty name")
+		}
+
+		// a password isn't needed for users that log in with a client certificate alone
+		certOnly := len(u.ClientCertNames) > 0 && !u.ClientCertRequirePassword
+
+		switch {
+		case u.PasswordHash != "":
+			if err := validatePasswordHash(u.PasswordHash); err != nil {
+				return nil, fmt.Errorf("user %s: %s", u.Name, err)
+			}
+		case u.Password == "" && !certOnly:
+			return nil, fmt.Errorf("user %s has an empty password", u.Name)
+		}
+
+		if u.Home != "" {
+			home := path.Clean(u.Home)
+			if strings.HasPrefix(home, "/") || home == "." || home == ".." || strings.HasPrefix(home, "../") {
+				return nil, fmt.Errorf("user %s has an invalid home prefix: %s", u.Name, u.Home)
+			}
+
+			// home is a directory so always has a trailing slash
+			u.Home = home + "/"
+		}
+
+		u.perms = permissions{}
+		for _, name := range u.Permissions {
+			p, ok := permissionProfiles[name]
+			if !ok {
+				return nil, fmt.Errorf("user %s has an unknown permission profile: %s", u.Name, name)
+			}
+
+			u.perms = u.perms.union(p)
+		}
+
+		if _, ok := m[u.Name]; ok {
+			return nil, fmt.Errorf("duplicate user: %s", u.Name)
+		}
+
+		m[u.Name] = u
+	}
+
+	return m, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeUsersFile(t *testing.T, contents string) string {
+	f, err := ioutil.TempFile("", "bucketftp-users")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err = f.WriteString(contents); err != nil {
+		t.Fatal(err)
+	}
+
+	return f.Name()
+}
+
+func TestLoadUserStore(t *testing.T) {
+	path := writeUsersFile(t, `{"users": [{"name": "wgtn", "password": "secret1"}, {"name": "akld", "password": "secret2"}]}`)
+	defer os.Remove(path)
+
+	var err error
+	var s *UserStore
+	if s, err = LoadUserStore(path); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		user, passwd string
+		errExpected  bool
+	}{
+		{"wgtn", "secret1", false},
+		{"akld", "secret2", false},
+		{"wgtn", "secret2", true},
+		{"akld", "", true},
+		{"chch", "secret1", true},
+		{"", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%s, %s, %t", tc.user, tc.passwd, tc.errExpected), func(t *testing.T) {
+			_, err := s.Authenticate(tc.user, tc.passwd, nil)
+			if (err != nil) != tc.errExpected {
+				t.Errorf("unexpected result authenticating %s: %v", tc.user, err)
+			}
+
+			// the same error for an unknown username and a wrong password
+			if err != nil && err != errIncorrectLogin {
+				t.Errorf("expected %q got %q", errIncorrectLogin, err)
+			}
+		})
+	}
+
+	if err = validatePasswordHash(dummyPasswordHash); err != nil {
+		t.Errorf("invalid dummy password hash: %s", err)
+	}
+
+	// rotate a password and reload
+	if err = ioutil.WriteFile(path, []byte(`{"users": [{"name": "wgtn", "password": "rotated"}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = s.Authenticate("wgtn", "secret1", nil); err == nil {
+		t.Error("expected the old password to fail after a reload")
+	}
+
+	if _, err = s.Authenticate("wgtn", "rotated", nil); err != nil {
+		t.Error(err)
+	}
+
+	if _, err = s.Authenticate("akld", "secret2", nil); err == nil {
+		t.Error("expected a removed user to fail after a reload")
+	}
+
+	// an invalid file keeps the existing users
+	if err = ioutil.WriteFile(path, []byte(`{"users": [{"name": "wgtn"`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Reload(); err == nil {
+		t.Error("expected an error reloading an invalid users file")
+	}
+
+	if _, err = s.Authenticate("wgtn", "rotated", nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInvalidUsers(t *testing.T) {
+	testCases := []string{
+		`{"users": [{"name": "", "password": "secret"}]}`,
+		`{"users": [{"name": "wgtn", "password": ""}]}`,
+		`{"users": [{"name": "wgtn", "password": "a"}, {"name": "wgtn", "password": "b"}]}`,
+		`not json`,
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc, func(t *testing.T) {
+			path := writeUsersFile(t, tc)
+			defer os.Remove(path)
+
+			if _, err := LoadUserStore(path); err == nil {
+				t.Errorf("expected an error loading users file: %s", tc)
+			}
+		})
+	}
+}